@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+)
+
+// Alarms watch a channel and go off when it gets past a threshold, a warning first and
+// then critical, so the engine cooking itself or a run of knock doesn't go unnoticed
+// while you're watching the road. They're set up in the config file:
+//
+//	"alarms": [
+//	  {"channel": "Coolant Temp", "warn": 100, "critical": 105, "hysteresis": 2, "duration": 3},
+//	  {"channel": "Knock Sum", "warn": 3, "critical": 6},
+//	  {"channel": "mut:Battery Level", "warn": 12.5, "critical": 11.5, "below": true, "duration": 10}
+//	]
+//
+// An alarm only goes off once the value has been past the threshold for "duration"
+// seconds, so one odd reading doesn't set it off, and only clears once the value
+// has come back past the threshold by "hysteresis", so a value sitting right on it
+// doesn't flick it on and off. "below" alarms are for values that shouldn't drop
+// under the thresholds rather than climb over them.
+
+type alarmLevel int
+
+const (
+	alarmClear alarmLevel = iota
+	alarmWarn
+	alarmCritical
+)
+
+func (l alarmLevel) String() string {
+	switch l {
+	case alarmWarn:
+		return "warning"
+	case alarmCritical:
+		return "critical"
+	}
+	return "clear"
+}
+
+// What colour a widget goes while its channel is in alarm
+func (l alarmLevel) colour() ui.Color {
+	if l == alarmCritical {
+		return ui.ColorRed
+	}
+	return ui.ColorYellow
+}
+
+// An alarm as written in the config file
+type alarmDefinition struct {
+	Channel    string   `json:"channel"`
+	Warn       *float64 `json:"warn"`
+	Critical   *float64 `json:"critical"`
+	Below      bool     `json:"below"`
+	Hysteresis float64  `json:"hysteresis"`
+	Duration   float64  `json:"duration"`
+}
+
+type alarm struct {
+	alarmDefinition
+	key      string
+	name     string
+	decimals int
+
+	level alarmLevel
+
+	// When the value got past each level's threshold, zero if it isn't past it
+	since [alarmCritical + 1]time.Time
+
+	// The latest value, for the banner
+	value SensorValue
+}
+
+// The alarm going off, getting worse or better, or clearing
+type alarmEvent struct {
+	at        time.Time
+	name      string
+	level     alarmLevel
+	previous  alarmLevel
+	value     string
+	threshold float64
+	below     bool
+}
+
+func (e alarmEvent) String() string {
+	if e.level == alarmClear {
+		return fmt.Sprintf("%s back to normal at %s", e.name, e.value)
+	}
+	past := "over"
+	if e.below {
+		past = "under"
+	}
+	return fmt.Sprintf("%s %s: %s, %s %g", e.name, e.level, e.value, past, e.threshold)
+}
+
+// Whether the alarm went off or got worse, rather than better
+func (e alarmEvent) raised() bool {
+	return e.level > e.previous
+}
+
+func newAlarm(definition alarmDefinition, env *formulaEnv) (*alarm, error) {
+	key, err := env.channel(definition.Channel)
+	if err != nil {
+		return nil, err
+	}
+	warn, critical := definition.Warn, definition.Critical
+	switch {
+	case warn == nil && critical == nil:
+		return nil, errors.New("needs a warn or critical threshold")
+	case warn != nil && critical != nil && !definition.Below && *critical < *warn:
+		return nil, fmt.Errorf("critical (%g) should be above warn (%g)", *critical, *warn)
+	case warn != nil && critical != nil && definition.Below && *critical > *warn:
+		return nil, fmt.Errorf("critical (%g) should be below warn (%g) for a below alarm", *critical, *warn)
+	case definition.Hysteresis < 0:
+		return nil, errors.New("hysteresis can't be negative")
+	case definition.Duration < 0:
+		return nil, errors.New("duration can't be negative")
+	}
+
+	_, name := splitChannelKey(key)
+	decimals := -1
+	if definition, known := channelDefinition(key); known {
+		decimals = definition.decimals
+	}
+	return &alarm{alarmDefinition: definition, key: key, name: name, decimals: decimals}, nil
+}
+
+func (a *alarm) threshold(level alarmLevel) *float64 {
+	switch level {
+	case alarmWarn:
+		return a.Warn
+	case alarmCritical:
+		return a.Critical
+	}
+	return nil
+}
+
+// Whether a value is past a level's threshold. Once a level's been reached the
+// value has to come back past its threshold by the hysteresis to leave it.
+func (a *alarm) past(level alarmLevel, value float64, reached bool) bool {
+	threshold := a.threshold(level)
+	if threshold == nil {
+		return false
+	}
+	t := *threshold
+	if a.Below {
+		if reached {
+			t += a.Hysteresis
+		}
+		return value <= t
+	}
+	if reached {
+		t -= a.Hysteresis
+	}
+	return value >= t
+}
+
+// Take a new value, returning an event if that changes the alarm's level
+func (a *alarm) check(value SensorValue, at time.Time) (alarmEvent, bool) {
+	// NaN isn't past any threshold, so a single bad conversion (a zero reading in a
+	// divide, say) would clear the alarm there and then, and the next real value would
+	// set it off all over again. It (or an infinity) says nothing about the channel
+	// either way, so stay where we are.
+	if math.IsNaN(value.SensorValue) || math.IsInf(value.SensorValue, 0) {
+		return alarmEvent{}, false
+	}
+	a.value = value
+	previous := a.level
+
+	// Better straight away once the value's come back far enough,
+	for a.level > alarmClear && !a.past(a.level, value.SensorValue, true) {
+		a.level--
+	}
+	// worse only once it's been past the threshold for long enough
+	duration := time.Duration(a.Duration * float64(time.Second))
+	for level := alarmWarn; level <= alarmCritical; level++ {
+		if !a.past(level, value.SensorValue, false) {
+			a.since[level] = time.Time{}
+			continue
+		}
+		if a.since[level].IsZero() {
+			a.since[level] = at
+		}
+		if level > a.level && at.Sub(a.since[level]) >= duration {
+			a.level = level
+		}
+	}
+
+	if a.level == previous {
+		return alarmEvent{}, false
+	}
+	event := alarmEvent{at: at, name: a.name, level: a.level, previous: previous, value: a.valueText(), below: a.Below}
+	if threshold := a.threshold(max(a.level, previous)); threshold != nil {
+		event.threshold = *threshold
+	}
+	return event, true
+}
+
+// The latest value, written out with its unit
+func (a *alarm) valueText() string {
+	text := strconv.FormatFloat(a.value.SensorValue, 'f', a.decimals, 64)
+	if a.value.SensorUnit != "" {
+		text += " " + a.value.SensorUnit
+	}
+	return text
+}
+
+// Every alarm from the config, checking each value that comes in against those for its channel
+type alarmMonitor struct {
+	alarms []*alarm
+	byKey  map[string][]*alarm
+}
+
+// Set the alarms up, once the profile is loaded so their channels can be found
+func newAlarmMonitor(definitions []alarmDefinition) (*alarmMonitor, error) {
+	m := &alarmMonitor{byKey: make(map[string][]*alarm)}
+	env := knownChannels()
+	for i, definition := range definitions {
+		a, err := newAlarm(definition, env)
+		if err != nil {
+			return nil, fmt.Errorf("alarm %d (%s): %w", i+1, definition.Channel, err)
+		}
+		m.alarms = append(m.alarms, a)
+		m.byKey[a.key] = append(m.byKey[a.key], a)
+	}
+	return m, nil
+}
+
+func (m *alarmMonitor) check(value SensorValue, at time.Time) []alarmEvent {
+	var events []alarmEvent
+	for _, a := range m.byKey["/"+value.SensorType+"/"+value.SensorLabel] {
+		if event, changed := a.check(value, at); changed {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Whether any of the channel's alarms are going off, for the banner to keep up with its value
+func (m *alarmMonitor) raisedOn(value SensorValue) bool {
+	for _, a := range m.byKey["/"+value.SensorType+"/"+value.SensorLabel] {
+		if a.level > alarmClear {
+			return true
+		}
+	}
+	return false
+}
+
+// The channels the alarms watch, for the MUT scheduler to keep polling
+func (m *alarmMonitor) keys() []string {
+	keys := make([]string, 0, len(m.byKey))
+	for key := range m.byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// How bad things are on each channel with an alarm going off
+func (m *alarmMonitor) levels() map[string]alarmLevel {
+	levels := make(map[string]alarmLevel)
+	for _, a := range m.alarms {
+		levels[a.key] = max(levels[a.key], a.level)
+	}
+	return levels
+}
+
+// The alarms going off, the worst first, and the worst level of them
+func (m *alarmMonitor) raised() ([]*alarm, alarmLevel) {
+	var raised []*alarm
+	worst := alarmClear
+	for _, a := range m.alarms {
+		if a.level > alarmClear {
+			raised = append(raised, a)
+			worst = max(worst, a.level)
+		}
+	}
+	sort.SliceStable(raised, func(i, j int) bool { return raised[i].level > raised[j].level })
+	return raised, worst
+}
+
+// A line for the banner, one alarm after another
+func describeAlarms(raised []*alarm) string {
+	descriptions := make([]string, len(raised))
+	for i, a := range raised {
+		descriptions[i] = strings.ToUpper(a.level.String()) + " " + a.name + " " + a.valueText()
+	}
+	return strings.Join(descriptions, " · ")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAlarmCheck(t *testing.T) {
+	warn, critical := 100.0, 105.0
+	lowWarn, lowCritical := 12.5, 11.5
+
+	type step struct {
+		at    float64 // seconds in
+		value float64
+		level alarmLevel
+	}
+	tests := []struct {
+		name       string
+		definition alarmDefinition
+		steps      []step
+	}{
+		{"raised straight away with no duration", alarmDefinition{Warn: &warn, Critical: &critical}, []step{
+			{0, 90, alarmClear},
+			{1, 100, alarmWarn},
+			{2, 110, alarmCritical},
+		}},
+		{"raised only once past it for the duration", alarmDefinition{Warn: &warn, Critical: &critical, Duration: 3}, []step{
+			{0, 101, alarmClear},
+			{2, 101, alarmClear},
+			{3, 106, alarmWarn},
+			{5, 106, alarmWarn},
+			{6, 106, alarmCritical},
+		}},
+		{"a dip restarts the duration", alarmDefinition{Warn: &warn, Duration: 3}, []step{
+			{0, 101, alarmClear},
+			{2, 99, alarmClear},
+			{4, 101, alarmClear},
+			{6, 101, alarmClear},
+			{7, 101, alarmWarn},
+		}},
+		{"cleared only once back by the hysteresis", alarmDefinition{Warn: &warn, Critical: &critical, Hysteresis: 2}, []step{
+			{0, 106, alarmCritical},
+			{1, 104, alarmCritical},
+			{2, 103, alarmCritical},
+			{3, 102.9, alarmWarn},
+			{4, 98.5, alarmWarn},
+			{5, 97.9, alarmClear},
+		}},
+		{"cleared straight to clear from critical", alarmDefinition{Warn: &warn, Critical: &critical, Hysteresis: 2}, []step{
+			{0, 106, alarmCritical},
+			{1, 90, alarmClear},
+		}},
+		{"below", alarmDefinition{Warn: &lowWarn, Critical: &lowCritical, Below: true, Hysteresis: 0.5}, []step{
+			{0, 13.8, alarmClear},
+			{1, 12.4, alarmWarn},
+			{2, 11.5, alarmCritical},
+			{3, 11.9, alarmCritical},
+			{4, 12.1, alarmWarn},
+			{5, 12.9, alarmWarn},
+			{6, 13.1, alarmClear},
+		}},
+		{"below with a duration", alarmDefinition{Warn: &lowWarn, Below: true, Duration: 10}, []step{
+			{0, 12, alarmClear},
+			{9, 12, alarmClear},
+			{10, 12, alarmWarn},
+		}},
+		{"NaN holds the level", alarmDefinition{Warn: &warn, Critical: &critical, Hysteresis: 2}, []step{
+			{0, 106, alarmCritical},
+			{1, math.NaN(), alarmCritical},
+			{2, math.Inf(-1), alarmCritical},
+			{3, 106, alarmCritical},
+		}},
+		{"NaN doesn't restart the duration", alarmDefinition{Warn: &warn, Duration: 3}, []step{
+			{0, 101, alarmClear},
+			{1, math.NaN(), alarmClear},
+			{3, 101, alarmWarn},
+		}},
+	}
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := &alarm{alarmDefinition: test.definition, name: "Coolant Temp", decimals: 1}
+			for _, step := range test.steps {
+				at := started.Add(time.Duration(step.at * float64(time.Second)))
+				previous := a.level
+				event, changed := a.check(SensorValue{SensorValue: step.value}, at)
+				if a.level != step.level {
+					t.Fatalf("%gs, %g: got %s, want %s", step.at, step.value, a.level, step.level)
+				}
+				if changed != (step.level != previous) {
+					t.Errorf("%gs, %g: event %t going from %s to %s", step.at, step.value, changed, previous, step.level)
+				}
+				if changed && (event.level != step.level || event.previous != previous) {
+					t.Errorf("%gs, %g: got event %+v", step.at, step.value, event)
+				}
+			}
+		})
+	}
+}
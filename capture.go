@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A capture is a record of every byte that went over the wire, for working
+// out what went wrong with the decoding after the fact and for replaying
+// a drive through the real decoders (see replay.go). It's plain text, a line
+// an event, timed from when the capture started:
+//
+//	# mut-dashboard capture, started 2024-05-04T10:15:02+10:00
+//	0.000212 mut open | ftdi:0403:6001
+//	0.000305 mut purge
+//	0.000311 mut init
+//	1.800920 mut > FF
+//	1.803415 mut < FF 4D
+//	1.901007 mut < 21 | timeout
+//	0.412100 imfd open | /dev/ttyUSB1
+//	0.498003 imfd frame 01 00 00 00 12 00 02 01 01 3F 40
+//	2.498541 imfd frame | error: imfd: no data
+//
+// Anything after a " | " is a note: what was opened, or why a read fell short.
+const captureHeader = "# mut-dashboard capture"
+
+// What happened, in the order the capture lists them
+const (
+	captureOpen  = "open"
+	captureClose = "close"
+	capturePurge = "purge"
+	captureInit  = "init"
+	captureWrite = ">"
+	captureRead  = "<"
+	captureFrame = "frame"
+)
+
+var (
+	errBadCapture    = errors.New("bad capture")
+	errCaptureClosed = errors.New("capture closed")
+)
+
+// One line of a capture
+type captureEvent struct {
+	// Since the capture started
+	at time.Duration
+
+	// Which source it came from ("mut", "imfd") and what happened
+	source string
+	kind   string
+	data   []byte
+	note   string
+}
+
+func (e captureEvent) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%.6f %s %s", e.at.Seconds(), e.source, e.kind)
+	if len(e.data) > 0 {
+		fmt.Fprintf(&b, " % X", e.data)
+	}
+	if e.note != "" {
+		b.WriteString(" | " + e.note)
+	}
+	return b.String()
+}
+
+// Writes a capture as things happen, from however many sources are running
+type captureWriter struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	started time.Time
+	err     error
+}
+
+// The capture everything is being recorded to, nil if we aren't capturing
+var activeCapture *captureWriter
+
+// Start capturing everything the sources send and receive to path
+func startCapture(path string) (func() error, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	capture := &captureWriter{file: f, writer: bufio.NewWriter(f), started: time.Now()}
+	fmt.Fprintf(capture.writer, "%s, started %s\n", captureHeader, capture.started.Format(time.RFC3339))
+
+	activeCapture = capture
+	return capture.close, nil
+}
+
+// Add an event to the capture, timed from the monotonic clock so changes
+// to the wall clock (the Pi getting its time from GPS, say) don't upset it
+func (c *captureWriter) record(source string, kind string, data []byte, note string) {
+	if c == nil {
+		return
+	}
+	event := captureEvent{time.Since(c.started), source, kind, data, note}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	// Straight out to the file, a capture is usually wanted because something crashed
+	fmt.Fprintln(c.writer, event)
+	c.err = c.writer.Flush()
+}
+
+func (c *captureWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.err
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	// The sources may still be going, anything they do from here on isn't wanted
+	c.err = errCaptureClosed
+	if err != nil {
+		return fmt.Errorf("capture %s: %w", c.file.Name(), err)
+	}
+	return nil
+}
+
+// Read a whole capture back in
+func readCapture(r io.Reader) ([]captureEvent, error) {
+	var events []captureEvent
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		event, err := parseCaptureEvent(text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errBadCapture, line, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("%w: no events in it", errBadCapture)
+	}
+	return events, nil
+}
+
+func parseCaptureEvent(text string) (captureEvent, error) {
+	var event captureEvent
+	text, event.note, _ = strings.Cut(text, " | ")
+
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return event, fmt.Errorf("expected a time, source and event in %q", text)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || seconds < 0 {
+		return event, fmt.Errorf("bad time %q", fields[0])
+	}
+	event.at = time.Duration(seconds * float64(time.Second))
+	event.source, event.kind = fields[1], fields[2]
+
+	switch event.kind {
+	case captureOpen, captureClose, capturePurge, captureInit:
+		if len(fields) > 3 {
+			return event, fmt.Errorf("%s doesn't take any bytes", event.kind)
+		}
+	case captureWrite, captureRead, captureFrame:
+		event.data, err = hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return event, fmt.Errorf("bad bytes: %v", err)
+		}
+	default:
+		return event, fmt.Errorf("unknown event %q", event.kind)
+	}
+	return event, nil
+}
+
+// Wraps a transport, recording everything that goes through it
+type capturingTransport struct {
+	ecuTransport
+	capture *captureWriter
+}
+
+func newCapturingTransport(transport ecuTransport, capture *captureWriter) *capturingTransport {
+	capture.record("mut", captureOpen, nil, transport.String())
+	return &capturingTransport{transport, capture}
+}
+
+func (t *capturingTransport) WriteRequest(data []byte) error {
+	t.capture.record("mut", captureWrite, data, "")
+	return t.ecuTransport.WriteRequest(data)
+}
+
+func (t *capturingTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	n, err := t.ecuTransport.ReadResponse(buf, timeout)
+	note := ""
+	switch {
+	case err == errTransportTimeout:
+		note = "timeout"
+	case err != nil:
+		note = "error: " + err.Error()
+	}
+	t.capture.record("mut", captureRead, buf[:n], note)
+	return n, err
+}
+
+func (t *capturingTransport) SlowInit() error {
+	t.capture.record("mut", captureInit, nil, "")
+	return t.ecuTransport.SlowInit()
+}
+
+func (t *capturingTransport) Purge() error {
+	t.capture.record("mut", capturePurge, nil, "")
+	return t.ecuTransport.Purge()
+}
+
+func (t *capturingTransport) Close() error {
+	t.capture.record("mut", captureClose, nil, "")
+	return t.ecuTransport.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The key a channel's values are stored under, e.g. "/mut-sensor/Engine RPM",
+// which is also how the UI refers to it. Sources are named as they are in
+// profiles ("mut", "imfd", "computed") and become the SensorType of their values.
+func channelKey(source string, name string) string {
+	return "/" + sourceSensorType(source) + "/" + name
+}
+
+// The SensorType a source's values are published with. Computed channels
+// aren't read from a sensor at all, so theirs is just "computed".
+func sourceSensorType(source string) string {
+	if source == computedSource {
+		return computedSource
+	}
+	return source + "-sensor"
+}
+
+// A channel from the profile, with what to call it in a log
+type channelInfo struct {
+	key      string
+	source   string
+	name     string
+	unit     string
+	decimals int
+}
+
+// The channels worth recording from the current profile: every MUT sensor
+// that gets polled at all, everything the iMFD sends and every computed channel
+func loggedChannels() []channelInfo {
+	sensorTablesMu.RLock()
+	defer sensorTablesMu.RUnlock()
+	var channels []channelInfo
+	for _, sensor := range mutSensors {
+		if sensor.rate > 0 {
+			channels = append(channels, channelInfo{channelKey("mut", sensor.name), "mut", sensor.name, sensor.unit, sensor.decimals})
+		}
+	}
+	for _, sensor := range imfdSensors {
+		channels = append(channels, channelInfo{channelKey("imfd", sensor.name), "imfd", sensor.name, sensor.unit, sensor.decimals})
+	}
+	for _, channel := range computedChannels {
+		channels = append(channels, channelInfo{channelKey(computedSource, channel.name), computedSource, channel.name, channel.unit, channel.decimals})
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].key < channels[j].key })
+	return channels
+}
+
+func loggedChannelKeys() []string {
+	channels := loggedChannels()
+	keys := make([]string, len(channels))
+	for i, channel := range channels {
+		keys[i] = channel.key
+	}
+	return keys
+}
+
+// The channel names each source has, in the profile in use and (when it's picked from
+// the ECU) any other it could switch to, for working out where a logged channel came from
+func knownChannels() *formulaEnv {
+	channels := map[string]map[string]bool{"mut": {}, "imfd": {}, computedSource: {}}
+	add := func(profile *sensorProfile) {
+		if profile == nil {
+			return
+		}
+		for _, definition := range profile.Mut {
+			channels["mut"][definition.Name] = true
+		}
+		for _, definition := range profile.Imfd {
+			channels["imfd"][definition.Name] = true
+		}
+		for _, definition := range profile.Computed {
+			channels[computedSource][definition.Name] = true
+		}
+	}
+
+	sensorTablesMu.RLock()
+	add(activeProfile)
+	sensorTablesMu.RUnlock()
+	if profileRegistry != nil {
+		for _, tables := range profileRegistry.profiles {
+			add(tables.profile)
+		}
+	}
+	return &formulaEnv{channels: channels}
+}
+
+// Split a channel key back into the source and the channel's name
+func splitChannelKey(key string) (string, string) {
+	sensorType, name, _ := strings.Cut(strings.TrimPrefix(key, "/"), "/")
+	return strings.TrimSuffix(sensorType, "-sensor"), name
+}
+
+// How a channel is defined in the current profile, for the dashboard to scale and format
+// it by. iMFD instances ("Exhaust Gas Temperature #2") share their sensor's definition.
+type channelRange struct {
+	unit     string
+	min      float64
+	max      float64
+	decimals int
+}
+
+func channelDefinition(key string) (channelRange, bool) {
+	source, name := splitChannelKey(key)
+	sensorTablesMu.RLock()
+	defer sensorTablesMu.RUnlock()
+	switch source {
+	case "mut":
+		for _, sensor := range mutSensors {
+			if sensor.name == name {
+				return channelRange{sensor.unit, sensor.min, sensor.max, sensor.decimals}, true
+			}
+		}
+	case "imfd":
+		base, _, _ := splitImfdChannelName(name)
+		for _, sensor := range imfdSensors {
+			if sensor.name == base {
+				return channelRange{sensor.unit, sensor.min, sensor.max, sensor.decimals}, true
+			}
+		}
+	case computedSource:
+		for _, channel := range computedChannels {
+			if channel.name == name {
+				return channelRange{channel.unit, channel.min, channel.max, channel.decimals}, true
+			}
+		}
+	}
+	return channelRange{}, false
+}
+
+// The latest value seen on every channel, so formulas can refer to other channels
+type channelStore struct {
+	mu     sync.RWMutex
+	values map[string]float64
+}
+
+var latestValues = &channelStore{values: make(map[string]float64)}
+
+func (s *channelStore) set(key string, value float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+func (s *channelStore) get(key string) (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Remember a decoded value for any formulas that refer to it
+func (s *channelStore) record(value SensorValue) {
+	s.set("/"+value.SensorType+"/"+value.SensorLabel, value.SensorValue)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ziutek/ftdi"
+	"go.bug.st/serial/enumerator"
+)
+
+// Where the debug log goes unless told otherwise
+const defaultLogFile = "/tmp/dashboard.log"
+
+// A subcommand, run with whatever arguments follow its name
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// The subcommands, in the order they're listed in the usage
+var commands = []command{
+	{"dash", "show the dashboard (the default)", runDash},
+	{"log", "record every sensor to a file without the dashboard", runLog},
+	{"play", "play a session log back on the dashboard", runPlay},
+	{"replay", "play a capture back on the dashboard", runReplay},
+	{"scan", "probe which MUT request IDs the ECU answers", runScan},
+	{"devices", "list FTDI cables and serial ports", runDevices},
+}
+
+func main() {
+	// Plain "dashboard -mut sim" still starts the dashboard
+	name, args := "dash", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
+	for _, command := range commands {
+		if command.name == name {
+			if err := command.run(args); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", command.name, command.summary)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags each command takes.\n", os.Args[0])
+}
+
+// The flags shared by everything that reads from the car, which
+// can also be given in a config file (the flags win)
+type sourceFlags struct {
+	fs      *flag.FlagSet
+	config  *string
+	capture *string
+}
+
+func addSourceFlags(fs *flag.FlagSet, withImfd bool) *sourceFlags {
+	flags := &sourceFlags{fs: fs}
+	flags.config = fs.String("config", "", "config file (JSON) naming the sources to run and the profile to use")
+	fs.String("mut", "", "MUT transport: ftdi[:VID:PID], serial:/dev/ttyUSB0, tcp:host:port, sim[:script], sim-pty[:script] or off (ftdi if not configured)")
+	if withImfd {
+		fs.String("imfd", "", "iMFD serial port, sim[:script] for the built-in simulator, or off (disabled if not configured)")
+	}
+	fs.String("profile", "", "sensor profile (JSON), or EvoScan/MitsuLogger XML as file.xml[#vehicle], picked from the ECU ID if empty")
+	flags.capture = fs.String("capture", "", "record every byte sent and received to this file, for the replay command")
+	return flags
+}
+
+// Read the config file and lay the flags that were given over the top of it
+func (f *sourceFlags) load() (*dashboardConfig, error) {
+	config, err := readDashboardConfig(*f.config)
+	if err != nil {
+		return nil, err
+	}
+	f.fs.Visit(func(flag *flag.Flag) {
+		switch flag.Name {
+		case "mut", "imfd":
+			config.Sources[flag.Name] = flag.Value.String()
+		case "profile":
+			config.Profile = flag.Value.String()
+		}
+	})
+	return config, nil
+}
+
+// Start capturing if we were asked to, returning a function to finish the capture
+func (f *sourceFlags) startCapture() (func() error, error) {
+	if *f.capture == "" {
+		return func() error { return nil }, nil
+	}
+	return startCapture(*f.capture)
+}
+
+// Send the debug log to a file, returning a function to close it
+func openDebugLog(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(f)
+	return func() {
+		log.SetOutput(os.Stderr)
+		f.Close()
+	}, nil
+}
+
+// List everything a cable could be plugged into
+func runDevices(args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	// FTDI cables are opened directly through libftdi, so they may not show up as a tty
+	fmt.Fprintf(w, "FTDI cables (%04X:%04X):\n", ftdiVendorId, ftdiProductId)
+	devices, err := ftdi.FindAll(ftdiVendorId, ftdiProductId)
+	if err != nil {
+		fmt.Fprintf(w, "  can't list them: %v\n", err)
+	}
+	for _, device := range devices {
+		fmt.Fprintf(w, "  ftdi:%04X:%04X\t%s %s\t%s\n", ftdiVendorId, ftdiProductId, device.Manufacturer, device.Description, device.Serial)
+		device.Close()
+	}
+	if err == nil && len(devices) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+
+	fmt.Fprintln(w, "Serial ports:")
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if port.IsUSB {
+			fmt.Fprintf(w, "  %s\tUSB %s:%s %s\t%s\n", port.Name, port.VID, port.PID, port.Product, port.SerialNumber)
+		} else {
+			fmt.Fprintf(w, "  %s\t\t\n", port.Name)
+		}
+	}
+	if len(ports) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import "math"
+
+// Computed channels are worked out from the other channels rather than read from a
+// sensor: AFR from the wideband's lambda, injector duty from the pulse width and RPM,
+// boost in kPa from the MDP sensor. The profile defines them like any other sensor,
+// with a formula over the channels they're computed from (and no x):
+//
+//	"computed": [
+//	  {"name": "AFR", "unit": "AFR", "formula": "[imfd:Wide-Band Air/Fuel] * 14.7", "min": 10, "max": 20, "decimals": 1},
+//	  {"name": "Injector Duty", "unit": "%", "formula": "[Injector Pulse Width] * [Engine RPM] / 1200", "min": 0, "max": 100, "decimals": 1}
+//	]
+//
+// Each is worked out again whenever one of its inputs comes in, and published as a
+// SensorValue with the SensorType "computed", so the dashboard, logs and alarms take
+// them just like the real thing. One can refer to computed channels defined before it.
+
+// What computed channels are called as a source, and the SensorType of their values
+const computedSource = "computed"
+
+type computedChannel struct {
+	name     string
+	unit     string
+	formula  func() float64
+	min      float64
+	max      float64
+	decimals int
+
+	// The keys of the channels it's worked out from
+	inputs []string
+}
+
+// The computed channels from the sensor profile, in the order it defines them
+var computedChannels []computedChannel
+
+// Whether a channel is one we compute ourselves
+func isComputedChannel(key string) bool {
+	sensorTablesMu.RLock()
+	defer sensorTablesMu.RUnlock()
+	for _, channel := range computedChannels {
+		if channelKey(computedSource, channel.name) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out every computed channel that uses a value that's just come in, and any
+// computed from those in turn, recording them in latestValues as we go. The value
+// itself must already be in there.
+func computeChannels(value SensorValue) []SensorValue {
+	sensorTablesMu.RLock()
+	channels := computedChannels
+	sensorTablesMu.RUnlock()
+
+	changed := map[string]bool{"/" + value.SensorType + "/" + value.SensorLabel: true}
+	var computed []SensorValue
+	// In the order they're defined, so a channel comes after any it's computed from
+	for _, channel := range channels {
+		uses := false
+		for _, input := range channel.inputs {
+			uses = uses || changed[input]
+		}
+		if !uses {
+			continue
+		}
+		// Until every input has come in (or when one's dividing by zero) there's nothing to show
+		result := channel.formula()
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			continue
+		}
+		output := SensorValue{channel.name, computedSource, 0, result, channel.unit}
+		latestValues.record(output)
+		changed[channelKey(computedSource, channel.name)] = true
+		computed = append(computed, output)
+	}
+	return computed
+}
+
+// Pass the demand for computed channels on to the channels they're computed from,
+// so a computed channel on screen gets its MUT sensors polled as if they were too
+func computedInputDemand(levels map[string]demandLevel) map[string]demandLevel {
+	sensorTablesMu.RLock()
+	defer sensorTablesMu.RUnlock()
+	// Backwards, so a channel computed from another passes its demand on before that one's looked at
+	for i := len(computedChannels) - 1; i >= 0; i-- {
+		channel := computedChannels[i]
+		level := levels[channelKey(computedSource, channel.name)]
+		for _, input := range channel.inputs {
+			levels[input] = max(levels[input], level)
+		}
+	}
+	return levels
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Settings that can be kept in a file rather than typed out every time.
+// Anything given on the command line wins over the file.
+//
+//	{
+//	  "sources": {"mut": "ftdi", "imfd": "/dev/ttyUSB1"},
+//	  "profile": "profiles/my-evo.json",
+//	  "layout": "layouts/track.json",
+//	  "alarms": [{"channel": "Coolant Temp", "warn": 100, "critical": 105}]
+//	}
+type dashboardConfig struct {
+	// Which data sources to run and where to find them, see sourceFactories.
+	// A source that is missing, empty or "off" isn't started.
+	Sources map[string]string `json:"sources"`
+
+	Profile string `json:"profile"`
+
+	// The dashboard layout, see dashboardLayout. The built-in one if empty.
+	Layout string `json:"layout"`
+
+	// Thresholds to warn about, see alarmDefinition
+	Alarms []alarmDefinition `json:"alarms"`
+}
+
+// What we run with when there's no config file, just the ECU on the usual cable
+func defaultDashboardConfig() *dashboardConfig {
+	return &dashboardConfig{Sources: map[string]string{"mut": defaultMutTransport}}
+}
+
+// Read the config file, or the defaults if the path is empty
+func readDashboardConfig(path string) (*dashboardConfig, error) {
+	config := defaultDashboardConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Sources given in the file replace the defaults rather than adding to them
+	config.Sources = nil
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	if config.Sources == nil {
+		config.Sources = make(map[string]string)
+	}
+	for name := range config.Sources {
+		if _, ok := sourceFactories[name]; !ok {
+			return nil, fmt.Errorf("config %s: unknown source %q", path, name)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The columns EvoScan starts every row with, which MegaLogViewer and friends
+// know to look for. The channels follow, one column each.
+var csvLogLeadingColumns = []string{"LogID", "LogEntryDate", "LogEntryTime", "LogEntrySeconds", "LogNotes"}
+
+// The default time between rows
+const csvLogDefaultPeriod = 100 * time.Millisecond
+
+// A logging session as EvoScan would write it: a row every period holding the
+// latest value of every channel, for opening in a log viewer afterwards.
+//
+// A CSV file can't grow columns half way down, so whenever the channels change
+// (the ECU turns out to need a different profile, a second EGT shows up)
+// the session moves on to a new file, session-20240504-101502-2.csv and so on.
+type csvSessionLog struct {
+	dir     string
+	name    string
+	started time.Time
+	period  time.Duration
+
+	// The file being written, nil until there's something to put in it
+	file   *os.File
+	writer *bufio.Writer
+	csv    *csv.Writer
+	paths  []string
+
+	columns []csvColumn
+	index   map[string]int
+
+	// The latest value of every column, ready to write,
+	// and anything to put in the LogNotes of the next row
+	row   []string
+	notes []string
+
+	// Whether anything has come in since the last row, and whether
+	// the columns have changed since the header was written
+	fresh   bool
+	changed bool
+
+	// When the last sample and note came in, to stamp the row written on close
+	lastSample time.Time
+	lastNote   time.Time
+	rows       uint64
+}
+
+type csvColumn struct {
+	channelInfo
+
+	// Turned up without being in the profile, so it's kept when the profile changes
+	discovered bool
+}
+
+// "Engine RPM (rpm)", the unit being the only place a log viewer can find it.
+// Names both sources use get the source in front ("imfd Throttle Position (%)"),
+// log viewers go by the header so they have to be told apart.
+func (c csvColumn) header(clash bool) string {
+	header := c.name
+	if clash {
+		header = c.source + " " + header
+	}
+	if c.unit != "" {
+		header += " (" + c.unit + ")"
+	}
+	return header
+}
+
+// Format a value to the number of decimals the profile gives, or
+// as few as it takes for channels the profile doesn't know about.
+// Log viewers choke on NaN and +Inf, so those leave the cell empty.
+func (c csvColumn) format(value float64) string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return ""
+	}
+	decimals := -1
+	if !c.discovered {
+		decimals = c.decimals
+	}
+	return strconv.FormatFloat(value, 'f', decimals, 64)
+}
+
+// Start a CSV session log in dir with the channels from the current profile.
+// Nothing is created until the first row is ready to write.
+func createCsvSessionLog(dir string, started time.Time, period time.Duration) (sampleLog, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("csv log period must be positive, not %s", period)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &csvSessionLog{
+		dir:     dir,
+		name:    "session-" + started.Format("20060102-150405"),
+		started: started,
+		period:  period,
+		index:   make(map[string]int),
+	}
+	l.setChannels(loggedChannels())
+	return l, nil
+}
+
+func (l *csvSessionLog) record(at time.Time, value SensorValue) error {
+	key := "/" + value.SensorType + "/" + value.SensorLabel
+	i, ok := l.index[key]
+	if !ok {
+		i = l.addColumn(csvColumn{channelInfo{key, strings.TrimSuffix(value.SensorType, "-sensor"), value.SensorLabel, value.SensorUnit, 0}, true})
+		l.changed = true
+	}
+	l.row[i] = l.columns[i].format(value.SensorValue)
+	l.fresh = true
+	l.lastSample = at
+	return nil
+}
+
+// Notes go in the LogNotes of the next row, which is written even if no samples come in
+func (l *csvSessionLog) note(at time.Time, text string) error {
+	l.notes = append(l.notes, text)
+	l.fresh = true
+	l.lastNote = at
+	return nil
+}
+
+func (l *csvSessionLog) addColumn(column csvColumn) int {
+	l.index[column.key] = len(l.columns)
+	l.columns = append(l.columns, column)
+	l.row = append(l.row, "")
+	return len(l.columns) - 1
+}
+
+// Write a row with the latest of everything, if anything has changed since the last one
+func (l *csvSessionLog) tick(at time.Time) error {
+	if !l.fresh {
+		return nil
+	}
+	if l.file == nil || l.changed {
+		if err := l.nextFile(); err != nil {
+			return err
+		}
+	}
+
+	l.rows++
+	record := make([]string, 0, len(csvLogLeadingColumns)+len(l.row))
+	record = append(record,
+		strconv.FormatUint(l.rows, 10),
+		at.Format("2006-01-02"),
+		at.Format("15:04:05.000"),
+		strconv.FormatFloat(at.Sub(l.started).Seconds(), 'f', 3, 64),
+		strings.Join(l.notes, "; "),
+	)
+	record = append(record, l.row...)
+	l.csv.Write(record)
+	l.fresh = false
+	l.notes = nil
+
+	// Out to the file every row, the OS can worry about getting it onto the disk
+	l.csv.Flush()
+	if err := l.csv.Error(); err != nil {
+		return fmt.Errorf("csv log %s: %w", l.path(), err)
+	}
+	return l.writer.Flush()
+}
+
+func (l *csvSessionLog) tickInterval() time.Duration {
+	return l.period
+}
+
+// Line the columns up with a new profile. Channels that aren't in it any
+// more are dropped, unless they turned up on their own in the first place.
+func (l *csvSessionLog) setChannels(channels []channelInfo) error {
+	oldColumns, oldRow := l.columns, l.row
+	l.columns, l.row, l.index = nil, nil, make(map[string]int)
+	for _, channel := range channels {
+		l.addColumn(csvColumn{channelInfo: channel})
+	}
+	for _, column := range oldColumns {
+		if _, ok := l.index[column.key]; !ok && column.discovered {
+			l.addColumn(column)
+		}
+	}
+
+	// Carry the values over, and see whether it's the same set of columns after all
+	same := len(oldColumns) == len(l.columns)
+	for i, column := range oldColumns {
+		if j, ok := l.index[column.key]; ok {
+			l.row[j] = oldRow[i]
+			same = same && i == j && column.channelInfo == l.columns[j].channelInfo
+		} else {
+			same = false
+		}
+	}
+	if !same {
+		l.changed = true
+	}
+	return nil
+}
+
+// Finish the current file (if any) and start the next with a header for the current columns
+func (l *csvSessionLog) nextFile() error {
+	if l.file != nil {
+		if err := l.closeFile(); err != nil {
+			return err
+		}
+		log.Printf("Channels changed, continuing the log in a new file")
+	}
+
+	name := l.name
+	if len(l.paths) > 0 {
+		name += "-" + strconv.Itoa(len(l.paths)+1)
+	}
+	path := filepath.Join(l.dir, name+".csv")
+
+	// Never write over an earlier session
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.file, l.paths = f, append(l.paths, path)
+	l.writer = bufio.NewWriter(f)
+	l.csv = csv.NewWriter(l.writer)
+	l.changed = false
+
+	names := make(map[string]int)
+	for _, column := range l.columns {
+		names[column.name]++
+	}
+	header := append([]string(nil), csvLogLeadingColumns...)
+	for _, column := range l.columns {
+		header = append(header, column.header(names[column.name] > 1))
+	}
+	l.csv.Write(header)
+	return nil
+}
+
+func (l *csvSessionLog) path() string {
+	return l.paths[len(l.paths)-1]
+}
+
+func (l *csvSessionLog) closeFile() error {
+	l.csv.Flush()
+	err := l.csv.Error()
+	if err == nil {
+		err = l.writer.Flush()
+	}
+	if syncErr := l.file.Sync(); syncErr != nil {
+		err = errors.Join(err, syncErr)
+	}
+	err = errors.Join(err, l.file.Close())
+	l.file = nil
+	if err != nil {
+		return fmt.Errorf("csv log %s: %w", l.path(), err)
+	}
+	return nil
+}
+
+// Write out whatever came in after the last row and close the file. A note can
+// come in after the last sample (or with no samples at all), so the row goes
+// down at whichever was later.
+func (l *csvSessionLog) close() error {
+	at := l.lastSample
+	if l.lastNote.After(at) {
+		at = l.lastNote
+	}
+	err := l.tick(at)
+	if l.file != nil {
+		err = errors.Join(err, l.closeFile())
+	}
+	return err
+}
+
+func (l *csvSessionLog) String() string {
+	if len(l.paths) == 0 {
+		return "nothing"
+	}
+	return fmt.Sprintf("%d rows to %s", l.rows, strings.Join(l.paths, ", "))
+}
+
+// Read a CSV session log (ours or EvoScan's) back in for playback, a frame per row
+func readCsvSessionLog(r io.Reader) ([]playbackFrame, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading the header: %w", err)
+	}
+
+	type playbackColumn struct {
+		index   int
+		channel SensorValue
+	}
+	leading := make(map[string]bool)
+	for _, name := range csvLogLeadingColumns {
+		leading[name] = true
+	}
+	seconds := -1
+	var columns []playbackColumn
+	env := knownChannels()
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "LogEntrySeconds":
+			seconds = i
+		case leading[name] || name == "":
+		default:
+			columns = append(columns, playbackColumn{i, parseCsvHeader(name, env)})
+		}
+	}
+	if seconds < 0 {
+		return nil, fmt.Errorf("no LogEntrySeconds column, it doesn't look like a session log")
+	}
+
+	// Times are from the start of the session, which may have been in an earlier file
+	var frames []playbackFrame
+	var started time.Duration
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		secs, err := strconv.ParseFloat(strings.TrimSpace(record[seconds]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: bad LogEntrySeconds %q", line, record[seconds])
+		}
+		at := time.Duration(secs * float64(time.Second))
+		if len(frames) == 0 {
+			started = at
+		}
+		frame := playbackFrame{at: at - started}
+		if len(frames) > 0 && frame.at < frames[len(frames)-1].at {
+			return nil, fmt.Errorf("line %d: LogEntrySeconds goes backwards", line)
+		}
+
+		for _, column := range columns {
+			text := strings.TrimSpace(record[column.index])
+			if text == "" {
+				// Nothing had come in for it yet
+				continue
+			}
+			value := column.channel
+			if value.SensorValue, err = strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("line %d: bad value %q for %s", line, text, header[column.index])
+			}
+			frame.values = append(frame.values, value)
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// Work out which channel a column holds from its header, the reverse of csvColumn.header.
+// Names no profile knows are taken to be MUT sensors, EvoScan's own logs being all MUT.
+func parseCsvHeader(header string, env *formulaEnv) SensorValue {
+	name, unit := header, ""
+	if i := strings.LastIndex(header, " ("); i > 0 && strings.HasSuffix(header, ")") {
+		name, unit = header[:i], header[i+2:len(header)-1]
+	}
+
+	// Either could be right, "Boost (MDP)" is a name with no unit
+	source, resolved, ok := resolveLoggedChannel(header, env)
+	if ok {
+		unit = ""
+	} else if source, resolved, ok = resolveLoggedChannel(name, env); !ok {
+		source, resolved = "mut", name
+	}
+
+	value := SensorValue{SensorLabel: resolved, SensorType: sourceSensorType(source), SensorUnit: unit}
+	if source == "imfd" {
+		_, value.SensorInstance, _ = splitImfdChannelName(resolved)
+	}
+	return value
+}
+
+// Find which source has a channel, going by the source in front
+// of the name if there is one ("imfd Throttle Position")
+func resolveLoggedChannel(name string, env *formulaEnv) (string, string, bool) {
+	if source, rest, ok := strings.Cut(name, " "); ok && env.hasChannel(source, rest) {
+		return source, rest, true
+	}
+	for _, source := range []string{"mut", "imfd", computedSource} {
+		if env.hasChannel(source, name) {
+			return source, name, true
+		}
+	}
+	return "", name, false
+}
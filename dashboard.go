@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"container/heap"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/ziutek/ftdi"
 	"go.bug.st/serial"
 	"log"
 	"os"
-	"strconv"
-	"sync"
 	"time"
 
 	ui "github.com/gizak/termui/v3"
@@ -30,390 +27,206 @@ type mutResponse struct {
 	value    uint16
 }
 
-type sensorQueue []*sensorRequest
-
-type sensorRequest struct {
-	sensorId uint16
-}
-
 type mutSensor struct {
 	name               string
 	unit               string
 	conversionFunction func(float64) float64
 	priority           string
+	rate               float64
+	min                float64
+	max                float64
+	decimals           int
 }
 
-var mutSensors = map[uint16]mutSensor{
-	0x0004: {
-		"Timing Advance Int",
-		"°",
-		func(sensorValue float64) float64 { return sensorValue - 20 },
-		"medium",
-	},
-	0x0006: {
-		"Timing Advance",
-		"°",
-		func(sensorValue float64) float64 { return sensorValue - 20 },
-		"medium",
-	},
-	0x0007: {
-		"Coolant Temp",
-		"C",
-		func(sensorValue float64) float64 { return sensorValue - 40 },
-		"medium",
-	},
-	0x000c: {
-		"Fuel Trim Low (LTFT)",
-		"%",
-		func(sensorValue float64) float64 { return (sensorValue - 128) / 5 },
-		"none",
-	},
-	0x000d: {
-		"Fuel Trim Mid (LTFT)",
-		"%",
-		func(sensorValue float64) float64 { return (sensorValue - 128) / 5 },
-		"none",
-	},
-	0x000e: {
-		"Fuel Trim High (LTFT)",
-		"%",
-		func(sensorValue float64) float64 { return (sensorValue - 128) / 5 },
-		"none",
-	},
-	0x000f: {
-		"Oxygen Feedback Trim (STFT)",
-		"%",
-		func(sensorValue float64) float64 { return (sensorValue - 128) / 5 },
-		"none",
-	},
-	0x0010: {
-		"Coolant Temp Scaled",
-		"C",
-		func(sensorValue float64) float64 { return sensorValue - 40 },
-		"medium",
-	},
-	0x0011: {
-		"MAF Air Temp",
-		"C",
-		func(sensorValue float64) float64 { return sensorValue - 40 },
-		"low",
-	},
-	0x0012: {
-		"EGR Temperature",
-		"C",
-		func(sensorValue float64) float64 { return (-2.7*sensorValue + 597.7) * 0.556 },
-		"medium",
-	},
-	0x0013: {
-		"Front Oxygen Sensor",
-		"V",
-		func(sensorValue float64) float64 { return 0.01952 * sensorValue },
-		"none",
-	},
-	0x0014: {
-		"Battery Level",
-		"V",
-		func(sensorValue float64) float64 { return 0.07333 * sensorValue },
-		"medium",
-	},
-	0x0015: {
-		"Barometer",
-		"kPa",
-		func(sensorValue float64) float64 { return 0.49 * sensorValue },
-		"none",
-	},
-	0x0016: {
-		"ISC Steps",
-		"steps",
-		func(sensorValue float64) float64 { return 100 * sensorValue / 120 },
-		"low",
-	},
-	0x0017: {
-		"Throttle Position",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue * 100 / 255 },
-		"high",
-	},
-	0x001a: {
-		"Air Flow Meter",
-		"Hz",
-		func(sensorValue float64) float64 { return 6.25 * sensorValue },
-		"medium",
-	},
-	0x001c: {
-		"Engine Load",
-		"%",
-		func(sensorValue float64) float64 { return 5 * sensorValue / 8 },
-		"medium",
-	},
-	0x001d: {
-		"Acceleration Enrichment",
-		"",
-		func(sensorValue float64) float64 { return 200 * sensorValue / 255 },
-		"none",
-	},
-	0x001f: {
-		"ECU Load Previous load",
-		"%",
-		func(sensorValue float64) float64 { return 5 * sensorValue / 8 },
-		"none",
-	},
-	0x0021: {
-		"Engine RPM",
-		"RPM",
-		func(sensorValue float64) float64 { return 31.25 * sensorValue },
-		"high",
-	},
-	0x0024: {
-		"Target Idle RPM",
-		"RPM",
-		func(sensorValue float64) float64 { return 7.8 * sensorValue },
-		"low",
-	},
-	0x0026: {
-		"Knock Sum",
-		"knocks",
-		func(sensorValue float64) float64 { return sensorValue },
-		"high",
-	},
-	0x0029: {
-		"Injector Pulse Width",
-		"ms",
-		func(sensorValue float64) float64 { return sensorValue / 1000 },
-		"medium",
-	},
-	0x002c: {
-		"Air Volume",
-		"",
-		func(sensorValue float64) float64 { return sensorValue },
-		"low",
-	},
-	0x002f: {
-		"Speed",
-		"km/h",
-		func(sensorValue float64) float64 { return 2 * sensorValue },
-		"high",
-	},
-	0x0030: {
-		"Knock Voltage",
-		"V",
-		func(sensorValue float64) float64 { return 0.0195 * sensorValue },
-		"none",
-	},
-	0x0031: {
-		"Volumetric Efficiency",
-		"V",
-		func(sensorValue float64) float64 { return 0.0195 * sensorValue },
-		"none",
-	},
-	0x0032: {
-		"Air/Fuel Ratio (Map)",
-		"AFR",
-		func(sensorValue float64) float64 { return (14.7 * 128) / sensorValue },
-		"medium",
-	},
-	0x0033: {
-		"Timing",
-		"°",
-		func(sensorValue float64) float64 { return sensorValue - 20 },
-		"high",
-	},
-	0x0038: {
-		"Boost (MDP)",
-		"PSI",
-		func(sensorValue float64) float64 { return 0.19348 * sensorValue },
-		"low",
-	},
-	0x0039: {
-		"Fuel Tank Pressure",
-		"PSI",
-		func(sensorValue float64) float64 { return sensorValue },
-		"none",
-	},
-	0x003c: {
-		"Rear Oxygen Sensor #1",
-		"V",
-		func(sensorValue float64) float64 { return 0.01952 * sensorValue },
-		"none",
-	},
-	0x003d: {
-		"Front Oxygen Sensor #2",
-		"V",
-		func(sensorValue float64) float64 { return 0.01952 * sensorValue },
-		"none",
-	},
-	0x003e: {
-		"Rear Oxygen Sensor #2",
-		"V",
-		func(sensorValue float64) float64 { return 0.01952 * sensorValue },
-		"none",
-	},
-	0x004a: {
-		"Purge Solenoid Duty Cycle",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue * 100 / 255 },
-		"none",
-	},
-	0x0080: {
-		"ECU ID Type",
-		"",
-		func(sensorValue float64) float64 { return sensorValue },
-		"none",
-	},
-	0x0082: {
-		"ECU ID Version",
-		"",
-		func(sensorValue float64) float64 { return sensorValue },
-		"none",
-	},
-	0x0085: {
-		"EGR Duty Cycle",
-		"",
-		func(sensorValue float64) float64 { return sensorValue / 1.28 },
-		"low",
-	},
-	0x0086: {
-		"Wastegate Duty Cycle",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue / 2 },
-		"low",
-	},
-	0x0096: {
-		"RAW MAF ADC value",
-		"V",
-		func(sensorValue float64) float64 { return sensorValue },
-		"none",
-	},
-}
+// The MUT sensor table, built from the sensor profile at startup
+var mutSensors map[uint16]mutSensor
 
 var sensorDataChannel = make(chan SensorValue)
 
-var mutResponses = make(chan mutResponse)
+// How long to wait for the ECU to answer a single request
+const mutResponseTimeout = 100 * time.Millisecond
+
+// Show the dashboard until the user quits
+func runDash(args []string) error {
+	fs := flag.NewFlagSet("dash", flag.ExitOnError)
+	flags := addSourceFlags(fs, true)
+	logFile := fs.String("logfile", defaultLogFile, "where to write the debug log")
+	layoutFile := fs.String("layout", "", "dashboard layout (JSON), reloaded whenever it's saved, the built-in one if empty")
+	fs.Parse(args)
+
+	config, err := flags.load()
+	if err != nil {
+		return err
+	}
+	if *layoutFile != "" {
+		config.Layout = *layoutFile
+	}
+
+	// Load the sensor definitions and set up the sources before anything starts talking
+	// to the car, bailing out before the UI takes over the terminal if they're no good
+	if err := useSensorProfile(config.Profile); err != nil {
+		return err
+	}
+	sources, err := configuredSources(config)
+	if err != nil {
+		return err
+	}
+	stopCapture, err := flags.startCapture()
+	if err != nil {
+		return err
+	}
+	defer stopCapture()
+
+	return showDashboard(sources, *logFile, config)
+}
+
+// Run the sources and show what they read until the user quits, laid out as the
+// config's layout file says (or the built-in layout if there isn't one) and
+// keeping an eye on the config's alarms
+func showDashboard(sources []dataSource, logFile string, config *dashboardConfig) error {
+	closeLog, err := openDebugLog(logFile)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	// A broken layout or alarm is best found out about before the UI takes over the terminal
+	layoutFile := config.Layout
+	layout, err := readDashboardLayout(layoutFile)
+	if err != nil {
+		return err
+	}
+	alarms, err := newAlarmMonitor(config.Alarms)
+	if err != nil {
+		return err
+	}
 
-func main() {
 	if err := ui.Init(); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer ui.Close()
 
-	f, err := os.OpenFile("/tmp/dashboard.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		panic(err)
+	// Start the sources, everything they read ends up on the sensorDataChannel
+	sourceManager := newSourceManager()
+	go sourceManager.merge(sensorDataChannel)
+	sourceManager.startAll(sources)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if layoutFile != "" {
+		go watchLayout(ctx, layoutFile)
 	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			panic(err)
+
+	// How each link is doing: the state, then for MUT which ECU (and profile) is on the other
+	// end of it and how fast it's going, and for the iMFD how many frames have made it through intact
+	links := map[string]*linkDisplay{
+		"mut":  {state: "Off", colour: ui.Theme.Paragraph.Text.Fg, detail: make([]string, 2)},
+		"imfd": {state: "Off", colour: ui.Theme.Paragraph.Text.Fg, detail: make([]string, 1)},
+	}
+	for _, source := range sources {
+		if link, ok := links[source.Name()]; ok {
+			link.state = linkConnecting.String()
 		}
-	}(f)
-	log.SetOutput(f)
-
-	var wg sync.WaitGroup
-
-	//wg.Add(1)
-	//go func() {
-	//	defer wg.Done()
-	//	imfdStream()
-	//}()
-
-	fmt.Println("Starting MUT Streamer")
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		mutStream()
-	}()
-
-	fmt.Println("Starting MUT Reader")
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		mutReader()
-	}()
-
-	// MAF Boost Pressure
-	boost := widgets.NewGauge()
-	boost.Percent = 0
-	boost.Title = "Boost"
-	boost.BarColor = ui.ColorRed
-	boost.BorderStyle.Fg = ui.ColorWhite
-	boost.TitleStyle.Fg = ui.ColorCyan
-
-	// Throttle Position Sensor
-	throttlePosition := widgets.NewGauge()
-	throttlePosition.Title = "Throttle Position"
-	throttlePosition.BarColor = ui.ColorRed
-	throttlePosition.BorderStyle.Fg = ui.ColorWhite
-	throttlePosition.LabelStyle.Fg = ui.ColorCyan
-
-	// Engine RPM Gauge
-	engineRPM := widgets.NewGauge()
-	engineRPM.Percent = 0
-	engineRPM.Title = "Engine RPM"
-	engineRPM.BarColor = ui.ColorGreen
-	engineRPM.BorderStyle.Fg = ui.ColorWhite
-	engineRPM.LabelStyle.Fg = ui.ColorCyan
-
-	// speed
-	wheelSpeed := widgets.NewParagraph()
-	wheelSpeed.Text = ""
-	wheelSpeed.Title = "Speed"
-	wheelSpeed.BorderStyle.Fg = ui.ColorBlack
-
-	// coolantTemp
-	coolantTemp := widgets.NewParagraph()
-	coolantTemp.Text = "N/A °C"
-	coolantTemp.Title = "Coolant Temp"
-	coolantTemp.BorderStyle.Fg = ui.ColorBlack
-
-	// intakeTemp
-	intakeTemp := widgets.NewParagraph()
-	intakeTemp.Text = "N/A °C"
-	intakeTemp.Title = "Intake Air"
-	intakeTemp.BorderStyle.Fg = ui.ColorBlack
-
-	// engineTiming
-	engineTiming := widgets.NewParagraph()
-	engineTiming.Text = "N/A °"
-	engineTiming.Title = "Engine Timing"
-	engineTiming.BorderStyle.Fg = ui.ColorBlack
-
-	// batteryVoltage
-	batteryVoltage := widgets.NewParagraph()
-	batteryVoltage.Text = "N/A V"
-	batteryVoltage.Title = "Batt. Voltage"
-	batteryVoltage.BorderStyle.Fg = ui.ColorBlack
-
-	// knockCount
-	knockCount := widgets.NewParagraph()
-	knockCount.Text = "N/A"
-	knockCount.Title = "Knock Count"
-	knockCount.BorderStyle.Fg = ui.ColorBlack
-
-	// Layout Grid
-	grid := ui.NewGrid()
+	}
+
+	// When playing a log back, where we are in it and the keys to get around
+	var playback *playbackSource
+	for _, source := range sources {
+		if p, ok := source.(*playbackSource); ok {
+			playback = p
+		}
+	}
+	playbackPosition := widgets.NewGauge()
+	if playback != nil {
+		playbackPosition.Title = "Playback: " + playback.path + " (space, +/-, ←/→, ,/., Home)"
+		playbackPosition.BarColor = ui.ColorBlue
+		playbackPosition.BorderStyle.Fg = ui.ColorWhite
+		playbackPosition.LabelStyle.Fg = ui.ColorCyan
+	}
+
+	// What's going off, across the top of every page
+	alarmBanner := widgets.NewParagraph()
+	alarmBanner.Title = "Alarms"
+	sensorDemand.set("alarms", demandAlarm, alarms.keys())
+	defer sensorDemand.clear("alarms")
+
+	// Why the layout file couldn't be used, while we carry on with the last one that could
+	layoutMessage := widgets.NewParagraph()
+	layoutMessage.TextStyle.Fg = ui.ColorRed
+	layoutMessage.BorderStyle.Fg = ui.ColorRed
+	var layoutErr error
+
+	// The latest value of every channel, to fill the widgets in straight away when they're
+	// rebuilt, and the ones before that (and the stats) for the graphs and stat widgets
+	lastValues := make(map[string]SensorValue)
+	history := newChannelHistory()
+	graphTicker := time.NewTicker(graphRedrawInterval)
+	defer graphTicker.Stop()
+
+	// Which page of the layout is showing
+	page := 0
+
+	var view *dashboardView
+	var tabs *widgets.TabPane
 	termWidth, termHeight := ui.TerminalDimensions()
-	grid.SetRect(0, 0, termWidth, termHeight)
-
-	grid.Set(
-		ui.NewRow(1.0/8,
-			ui.NewCol(1.0/6, engineTiming),
-			ui.NewCol(1.0/6, wheelSpeed),
-			ui.NewCol(1.0/6, knockCount),
-			ui.NewCol(1.0/6, batteryVoltage),
-			ui.NewCol(1.0/6, intakeTemp),
-			ui.NewCol(1.0/6, coolantTemp),
-		),
-		ui.NewRow(2.0/8,
-			ui.NewCol(1.0/1, throttlePosition),
-		),
-		ui.NewRow(2.0/8,
-			ui.NewCol(1.0/1, engineRPM),
-		),
-		ui.NewRow(2.0/8,
-			ui.NewCol(1.0/1, boost),
-		),
-	)
-	ui.Render(grid)
+	resize := func() {
+		// With more than one page, the tabs for them go along the top
+		top := 0
+		if len(layout.Pages) > 1 {
+			top = 1
+			tabs.SetRect(0, 0, termWidth, top)
+		}
+		view.grid.SetRect(0, top, termWidth, termHeight)
+		ui.Clear()
+		ui.Render(view.grid)
+		view.redrawGraphs(history, time.Now())
+		if top > 0 {
+			ui.Render(tabs)
+		}
+	}
+	rebuild := func() {
+		var top, bottom []ui.Drawable
+		if raised, worst := alarms.raised(); len(raised) > 0 {
+			alarmBanner.Text = describeAlarms(raised)
+			alarmBanner.TextStyle.Fg = worst.colour()
+			alarmBanner.BorderStyle.Fg = worst.colour()
+			top = append(top, alarmBanner)
+		}
+		if playback != nil {
+			bottom = append(bottom, playbackPosition)
+		}
+		if layoutErr != nil {
+			layoutMessage.Text = layoutErr.Error()
+			bottom = append(bottom, layoutMessage)
+		}
+		tabs = newPageTabs(layout)
+		tabs.ActiveTabIndex = page
+		view = newDashboardView(&layout.Pages[page], top, bottom)
+		history.watchThresholds(layout)
+		for _, value := range lastValues {
+			for _, widget := range view.widgets["/"+value.SensorType+"/"+value.SensorLabel] {
+				widget.show(value)
+			}
+		}
+		for source, link := range links {
+			for _, widget := range view.links[source] {
+				widget.Text = link.text()
+				widget.TextStyle.Fg = link.colour
+			}
+		}
+		view.setAlarms(alarms.levels())
+		resize()
+
+		// Let the MUT scheduler know what's on screen, so those get polled first
+		sensorDemand.set("dashboard", demandVisible, view.channels())
+	}
+	showPage := func(n int) {
+		if n != page && n >= 0 && n < len(layout.Pages) {
+			page = n
+			rebuild()
+		}
+	}
+	rebuild()
 
 	// Event Loop
 	uiEvents := ui.PollEvents()
@@ -422,306 +235,336 @@ func main() {
 		case e := <-uiEvents:
 			switch e.ID {
 			case "q", "<C-c>":
-				//wg.Wait()
-				return
+				return nil
 			case "<Resize>":
 				payload := e.Payload.(ui.Resize)
-				grid.SetRect(0, 0, payload.Width, payload.Height)
-				ui.Clear()
-				ui.Render(grid)
+				termWidth, termHeight = payload.Width, payload.Height
+				resize()
+			case "<Tab>":
+				showPage((page + 1) % len(layout.Pages))
+			case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+				showPage(int(e.ID[0] - '1'))
+			case "r":
+				// Between pulls, so the next one's peaks are its own
+				now := time.Now()
+				log.Printf("Stats reset")
+				history.resetStats(now)
+				view.redrawGraphs(history, now)
+			default:
+				if control, ok := playbackKeys[e.ID]; ok && playback != nil {
+					playback.control(control)
+				}
+			}
+		case update := <-layoutChannel:
+			if update.err != nil {
+				log.Printf("Keeping the current layout: %v", update.err)
+			} else {
+				log.Printf("Layout %s changed, reloaded it", layoutFile)
+				// Stay on the same page if it's still there
+				name := layout.Pages[page].Name
+				layout, page = update.layout, 0
+				for i := range layout.Pages {
+					if layout.Pages[i].Name == name {
+						page = i
+					}
+				}
+			}
+			layoutErr = update.err
+			rebuild()
+		case now := <-graphTicker.C:
+			view.redrawGraphs(history, now)
+		case status := <-playbackStatusChannel:
+			playbackPosition.Percent = status.percent()
+			playbackPosition.Label = status.String()
+			ui.Render(playbackPosition)
+		case status := <-linkStatusChannel:
+			if link, ok := links[status.source]; ok {
+				link.state = status.state.String()
+				link.colour = linkStateColour(status.state)
+				view.showLink(status.source, link)
 			}
+		case status := <-ecuProfileChannel:
+			links["mut"].detail[0] = status.describe()
+			// The profile decides the gauges' ranges and how many decimals the values get
+			rebuild()
+		case stats := <-imfdStatsChannel:
+			frames := stats.String()
+			if stats.bad+stats.runt > 0 {
+				frames = "[" + frames + "](fg:yellow)"
+			}
+			links["imfd"].detail[0] = frames
+			view.showLink("imfd", links["imfd"])
+		case report := <-mutPollChannel:
+			links["mut"].detail[1] = report.String()
+			view.showLink("mut", links["mut"])
 		case payload := <-sensorDataChannel:
 			log.Printf("[UI Loop] Incoming Payload: |%s/%s| -> %f [%s]", payload.SensorType, payload.SensorLabel, payload.SensorValue, payload.SensorUnit)
-			fullLabel := fmt.Sprintf("/%s/%s", payload.SensorType, payload.SensorLabel)
-			switch fullLabel {
-			case "/imfd-sensor/Boost":
-				limit := 1.7
-				boost.Percent = int((payload.SensorValue / limit) * 100)
-				boost.Label = fmt.Sprintf("%f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(boost)
-			case "/mut-sensor/Throttle Position":
-				throttlePosition.Percent = int(payload.SensorValue)
-				ui.Render(throttlePosition)
-			case "/mut-sensor/Engine RPM":
-				limit := 8000.0
-				engineRPM.Percent = int((payload.SensorValue / limit) * 100)
-				engineRPM.Label = fmt.Sprintf("%.0f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(engineRPM)
-			case "/mut-sensor/Speed":
-				wheelSpeed.Text = fmt.Sprintf("%.1f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(wheelSpeed)
-			case "/mut-sensor/Coolant Temp":
-				coolantTemp.Text = fmt.Sprintf("%.0f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(coolantTemp)
-			case "/mut-sensor/Knock Sum":
-				knockCount.Text = fmt.Sprintf("%.0f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(knockCount)
-			case "/mut-sensor/MAF Air Temp":
-				intakeTemp.Text = fmt.Sprintf("%.1f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(intakeTemp)
-			case "/mut-sensor/Timing Advance":
-				engineTiming.Text = fmt.Sprintf("%.1f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(engineTiming)
-			case "/mut-sensor/Battery Level":
-				batteryVoltage.Text = fmt.Sprintf("%.1f %s", payload.SensorValue, payload.SensorUnit)
-				ui.Render(batteryVoltage)
+			lastValues["/"+payload.SensorType+"/"+payload.SensorLabel] = payload
+			now := time.Now()
+			history.record(payload, now)
+			view.show(payload)
+
+			events := alarms.check(payload, now)
+			for _, event := range events {
+				log.Printf("[Alarm] %s", event)
+				if event.raised() {
+					// Ring the terminal's bell, termui has no way to
+					os.Stdout.WriteString("\a")
+				}
+			}
+			if len(events) > 0 {
+				// The banner comes or goes, and widgets change colour
+				rebuild()
+			} else if alarms.raisedOn(payload) {
+				raised, _ := alarms.raised()
+				alarmBanner.Text = describeAlarms(raised)
+				ui.Render(alarmBanner)
 			}
 		}
 	}
 }
 
-func logError(err error, andPanic bool) {
-	if err != nil {
-		if andPanic == true {
-			panic(err)
-		} else {
-			log.Fatal(err)
-		}
+// Pick a colour for the link state so problems stand out at a glance
+func linkStateColour(state linkState) ui.Color {
+	switch state {
+	case linkUp:
+		return ui.ColorGreen
+	case linkConnecting, linkDegraded:
+		return ui.ColorYellow
 	}
-}
-
-// Sensor Queue
-
-func (pq sensorQueue) Len() int { return len(pq) }
-
-func (pq sensorQueue) Less(i, j int) bool {
-	// Compare based on index instead of priority
-	return i < j
-}
-
-func (pq sensorQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-}
-
-func (pq *sensorQueue) Push(x interface{}) {
-	item := x.(*sensorRequest)
-	*pq = append(*pq, item)
-}
-
-func (pq *sensorQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	*pq = old[0 : n-1]
-	return item
+	return ui.ColorRed
 }
 
 // MUT sensors
-func mutSerialInit() *ftdi.Device {
-	// define a 2 byte buffer to store the response from the ECU
-	var buf [2]byte
-
+func mutSerialInit(transport ecuTransport) (mutCodec, ecuIdentity, error) {
 	// Steps:
-	// Open the Serial Driver
-	// Reset the device
 	// Purge the RX and TX buffers on the device
-	// Set the baud rate to 15625 baud
-	// Set 8bits, 1 stop bit, no parity
-	// Disable flow control
-	// Set Latency timers
 	// Initialize the MCU by sending 0x00 at 5 baud
 	// Send 0xFF and 0xFE to get the ECU ID
-	// ???
+	// Send 0x80 and 0x82 to get the ROM ID
 	// Profit
-
-	serialDevice, error := ftdi.OpenFirst(0x0403, 0x6001, ftdi.ChannelAny)
-	logError(error, true)
-
-	// Reset the device
-	serialDevice.Reset()
-	serialDevice.PurgeBuffers()
-	serialDevice.SetBaudrate(15625)
-	serialDevice.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOff)
-	serialDevice.SetFlowControl(ftdi.FlowCtrlDisable)
-	serialDevice.SetLatencyTimer(1)
-
-	// MUT requires 0x00 to be sent to the ECU to start the stream
-	// but at 5 baud. Instead, we can simply hold break
-	// to start the stream, which is basically the same thing.
-	// The original C code did the following between toggling break:
-	// usleep(1800 * 1000)
-	serialDevice.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOn)
-	time.Sleep(1800 * time.Millisecond)
-	serialDevice.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOff)
+	var identity ecuIdentity
+	if err := transport.Purge(); err != nil {
+		return mutCodec{}, identity, err
+	}
+	if err := transport.SlowInit(); err != nil {
+		return mutCodec{}, identity, err
+	}
 
 	// To make sure we have communication with the ECU,
 	// We can ask for the ECU ID, this is done by sending 0xFF then 0xFE
-	// The ECU should respond with two bytes, which combined will be the ECU ID
+	// The ECU should respond with one byte to each, which combined will be the ECU ID.
+	// The first request also tells us whether the cable echoes our requests back.
+	codec, idHigh, err := mutDetectEcho(transport)
+	if err != nil {
+		return codec, identity, fmt.Errorf("ECU initialization failed: %w", err)
+	}
+	idLow, err := mutExchange(transport, codec, mutRequestEcuIdLow)
+	if err != nil {
+		return codec, identity, fmt.Errorf("ECU initialization failed: %w", err)
+	}
+	identity.ecuId = uint16(idHigh)<<8 | uint16(idLow)
+
+	// The ROM ID narrows it down to the exact calibration, if the ECU will tell us
+	if err := mutReadRomId(transport, codec, &identity); err != nil {
+		return codec, identity, fmt.Errorf("ECU initialization failed: %w", err)
+	}
 
-	// define the array of the bytes to send to the ECU
-	bytes := []byte{0xFF, 0xFE}
+	log.Printf("%s (echo: %t)", identity, codec.echo)
 
-	// Loop through the bytes and send them to the ECU
-	for _, b := range bytes {
-		serialDevice.Write([]byte{b})
-		bytes, err := serialDevice.Read(buf[:])
-		logError(err, false)
+	return codec, identity, nil
+}
 
-		if bytes < 1 || bytes > 2 {
-			log.Fatal("ECU Initialization Failed: Expected between 1..2 byte(s), got ", bytes)
+// This is the main loop for the MUT stream
+// It keeps a session with the ECU running, starting a new one
+// (with a growing delay) whenever the link drops, until ctx is cancelled
+func mutStream(ctx context.Context, transportSpec string, responses chan<- mutResponse) {
+	backoff := mutReconnectMinBackoff
+	for {
+		reportLinkStatus(linkStatus{"mut", linkConnecting, transportSpec})
+
+		connected, err := mutSession(ctx, transportSpec, responses)
+		if ctx.Err() != nil {
+			reportLinkStatus(linkStatus{"mut", linkDown, "stopped"})
+			return
+		}
+		if connected {
+			// We had a working link, so start backing off from scratch
+			backoff = mutReconnectMinBackoff
 		}
-	}
 
-	log.Printf("ECU ID: %s", buf)
+		state := linkDown
+		if errors.Is(err, errMutEcuAsleep) {
+			state = linkAsleep
+		}
+		reportLinkStatus(linkStatus{"mut", state, fmt.Sprintf("%v, retrying in %s", err, backoff)})
 
-	return serialDevice
+		if !sleepContext(ctx, backoff) {
+			reportLinkStatus(linkStatus{"mut", linkDown, "stopped"})
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
 }
 
-// This is the main loop for the MUT stream
+// A single session with the ECU, from opening the transport until the link is lost.
 // It is responsible for defining what sensors need to be checked
-// and then checking them at a regular interval
-func mutStream() {
+// and then checking them at a regular interval.
+// Returns whether the ECU was ever talking to us, and what ended the session.
+func mutSession(ctx context.Context, transportSpec string, responses chan<- mutResponse) (bool, error) {
 
-	// Call the mutSerialInit function to initialize the serial device,
+	// Open whatever the ECU is hanging off
+	ecuTransport, err := openTransport(transportSpec)
+	if err != nil {
+		return false, err
+	}
+	defer ecuTransport.Close()
+	log.Printf("MUT transport: %s", ecuTransport)
+
+	// Call the mutSerialInit function to initialize the transport,
 	// this should get the ECU ready to talk to us
-	ecuSerialDevice := mutSerialInit()
-
-	// Define the sensor queues
-	highPriorityQueue := make(sensorQueue, 0)
-	mediumPriorityQueue := make(sensorQueue, 0)
-	lowPriorityQueue := make(sensorQueue, 0)
-
-	// Define the temporary queues
-	highPriorityTempQueue := make(sensorQueue, 0)
-	mediumPriorityTempQueue := make(sensorQueue, 0)
-	lowPriorityTempQueue := make(sensorQueue, 0)
-
-	// Initialize the queue
-	heap.Init(&highPriorityQueue)
-	heap.Init(&mediumPriorityQueue)
-	heap.Init(&lowPriorityQueue)
-
-	// Loop over the mutSensors, pushing them onto the queue
-	// if the priority is -99, skip them.
-	// Loop over the mutSensors, pushing them onto the appropriate queue
-	// if the priority is 'none', skip them.
-	for sensorId, sensor := range mutSensors {
-		if sensor.priority == "none" {
-			continue
-		}
-		switch sensor.priority {
-		case "high":
-			heap.Push(&highPriorityQueue, &sensorRequest{sensorId: sensorId})
-		case "medium":
-			heap.Push(&mediumPriorityQueue, &sensorRequest{sensorId: sensorId})
-		case "low":
-			heap.Push(&lowPriorityQueue, &sensorRequest{sensorId: sensorId})
-		}
+	codec, identity, err := mutSerialInit(ecuTransport)
+	if err != nil {
+		return false, err
 	}
 
-	// Define the tickers
-	highPriorityTicker := time.NewTicker(time.Millisecond * 20)
-	mediumPriorityTicker := time.NewTicker(time.Millisecond * 40)
-	lowPriorityTicker := time.NewTicker(time.Millisecond * 100)
+	// Now we know which ECU this is, make sure we're using the right sensors for it
+	selectEcuProfile(identity)
+	reportLinkStatus(linkStatus{"mut", linkUp, ecuTransport.String()})
+	health := &mutLinkHealth{transport: ecuTransport}
 
-	defer highPriorityTicker.Stop()
-	defer mediumPriorityTicker.Stop()
-	defer lowPriorityTicker.Stop()
+	// Poll the sensors one at a time, each as close to its target rate as the bus allows,
+	// with the plan reshaped whenever the widgets, loggers or alarms want something else
+	demandChanged := sensorDemand.changed()
+	scheduler := newMutScheduler(mutDemandPlan(), time.Now())
 
 	for {
 		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-demandChanged:
+			demandChanged = sensorDemand.changed()
+			scheduler.update(mutDemandPlan(), time.Now())
+		default:
+		}
 
-		case <-highPriorityTicker.C:
-			if highPriorityQueue.Len() == 0 {
-				// If the main queue is empty, push all sensors from the temporary queue back to the main queue
-				for highPriorityTempQueue.Len() > 0 {
-					sensorRequest := heap.Pop(&highPriorityTempQueue).(*sensorRequest)
-					heap.Push(&highPriorityQueue, sensorRequest)
-				}
-				continue
+		sensorRequest, wait := scheduler.next(time.Now())
+		if sensorRequest == nil {
+			// Nothing due yet, wait for it unless the plan changes first
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-demandChanged:
+				timer.Stop()
+			case <-ctx.Done():
+				timer.Stop()
 			}
-			// Pop the first item off the high priority queue
-			sensorRequest := heap.Pop(&highPriorityQueue).(*sensorRequest)
-			processSensorRequest(ecuSerialDevice, &highPriorityQueue, &highPriorityTempQueue, sensorRequest)
-		case <-mediumPriorityTicker.C:
-			if mediumPriorityQueue.Len() == 0 {
-				// If the main queue is empty, push all sensors from the temporary queue back to the main queue
-				for mediumPriorityTempQueue.Len() > 0 {
-					sensorRequest := heap.Pop(&mediumPriorityTempQueue).(*sensorRequest)
-					heap.Push(&mediumPriorityQueue, sensorRequest)
-				}
-				continue
-			}
-			// Pop the first item off the medium priority queue
-			sensorRequest := heap.Pop(&mediumPriorityQueue).(*sensorRequest)
-			processSensorRequest(ecuSerialDevice, &mediumPriorityQueue, &mediumPriorityTempQueue, sensorRequest)
-		case <-lowPriorityTicker.C:
-			if lowPriorityQueue.Len() == 0 {
-				for lowPriorityTempQueue.Len() > 0 {
-					sensorRequest := heap.Pop(&lowPriorityTempQueue).(*sensorRequest)
-					heap.Push(&lowPriorityQueue, sensorRequest)
-				}
-				continue // Nothing to do
-			}
-			// Pop the first item off the low priority queue
-			sensorRequest := heap.Pop(&lowPriorityQueue).(*sensorRequest)
-			processSensorRequest(ecuSerialDevice, &lowPriorityQueue, &lowPriorityTempQueue, sensorRequest)
+			continue
+		}
+
+		started := time.Now()
+		err := processSensorRequest(ctx, ecuTransport, codec, responses, sensorRequest)
+		scheduler.done(sensorRequest, started, time.Now(), err)
+
+		if report, ok := scheduler.report(time.Now()); ok {
+			reportMutPoll(report)
+		}
+
+		// See how the ECU is holding up, bailing out if the link has gone
+		if err = health.record(err); err != nil {
+			return true, err
 		}
 	}
 }
 
-func processSensorRequest(ecuSerialDevice *ftdi.Device, queue *sensorQueue, tempQueue *sensorQueue, sensorRequest *sensorRequest) {
+// Work out the polling plan from what the subscribers currently want
+func mutDemandPlan() map[uint16]float64 {
+	levels, subscribed := sensorDemand.snapshot()
+	levels = computedInputDemand(levels)
+	sensorTablesMu.RLock()
+	sensors := mutSensors
+	sensorTablesMu.RUnlock()
+	rates := mutPollPlan(sensors, levels, subscribed)
+	log.Printf("MUT poll plan for %v: %d sensors", sensorDemand.subscriberNames(), len(rates))
+	return rates
+}
+
+func processSensorRequest(ctx context.Context, ecuTransport ecuTransport, codec mutCodec, responses chan<- mutResponse, sensorRequest *sensorRequest) error {
 	// Send the requested sensor ID (byte) to the ECU and store the response
-	response := mutWriter(*ecuSerialDevice, sensorRequest.sensorId)
+	response, err := mutWriter(ecuTransport, codec, sensorRequest.sensorId)
+	if err != nil {
+		log.Printf("MUT Request for Sensor %s failed: %v", mutSensorName(sensorRequest.sensorId), err)
+		return err
+	}
 	log.Println("Response: ", response)
 
-	// Send the response to the mutResponses channel
-	mutResponses <- mutResponse{sensorRequest.sensorId, response}
+	// Send the response on to the mutReader, unless we're being stopped, in which
+	// case the reader may have gone already. That's not the ECU's fault, so no error.
+	select {
+	case responses <- mutResponse{sensorRequest.sensorId, response}:
+	case <-ctx.Done():
+	}
 
-	// Push the sensor request back to the temporary queue instead of the main queue
-	heap.Push(tempQueue, sensorRequest)
-	log.Println("Queue: ", *queue)
+	return nil
 }
 
 // This function fires when a response is received from the ECU from the mutStream
-// It is responsible for decoding the response and sending it to the sensorDataChannel
-// for the UI to display
-func mutReader() {
-	for payload := range mutResponses {
+// It is responsible for decoding the response and sending it on to out
+// for the UI to display, until the responses channel is closed or ctx is cancelled
+func mutReader(ctx context.Context, responses <-chan mutResponse, out chan<- SensorValue) {
+	for payload := range responses {
 
 		// Decode the response into a struct
-		decodedData := mutSensorDecode(
+		decodedData, err := mutSensorDecode(
 			payload.sensorId,
 			float64(payload.value),
 		)
+		if err != nil {
+			// The profile was reloaded without it while the request was out
+			log.Printf("[MUT Reader] Skipping response: %v", err)
+			continue
+		}
 		log.Printf("[MUT Reader] Decoded Payload: |%s/%s| -> %f", decodedData.SensorType, decodedData.SensorLabel, decodedData.SensorValue)
 
 		// Send the decoded data to the channel
-		sensorDataChannel <- decodedData
+		select {
+		case out <- decodedData:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 // Request a sensor value from the ECU and return the response
-func mutWriter(ftdiDevice ftdi.Device, sensorId uint16) uint16 {
-	log.Printf("Sending MUT Request for Sensor: %s", mutSensors[sensorId].name)
-
-	// initialise the buffer with the sensor ID
-	var outputBuffer = make([]byte, 2)
-	binary.BigEndian.PutUint16(outputBuffer, sensorId)
-
-	// write the sensor ID to the ECU then
-	// read the response into the 'bytes' variable
-	ftdiDevice.Write(outputBuffer)
-	bytes, err := ftdiDevice.Read(outputBuffer)
-
-	// log any errors
-	logError(err, false)
-
-	// we're expecting a value of at least 1 byte, check that we got one
-	if bytes < 1 {
-		log.Fatal("Expected more than 0 bytes got ", bytes)
-	}
+func mutWriter(ecuTransport ecuTransport, codec mutCodec, sensorId uint16) (uint16, error) {
+	log.Printf("Sending MUT Request for Sensor: %s", mutSensorName(sensorId))
 
-	// return the response from the ECU
-	return uint16(bytes)
+	// write the request(s) for the sensor to the ECU then
+	// pick the value out of what comes back
+	return mutReadSensor(ecuTransport, codec, sensorId)
 }
 
 // Decode the sensor response from the ECU into a struct, and perform any necessary conversions
 // then return it to the mutReader
-func mutSensorDecode(sensorType uint16, sensorValue float64) SensorValue {
-	sensor := mutSensors[sensorType]
+func mutSensorDecode(sensorType uint16, sensorValue float64) (SensorValue, error) {
+	sensorTablesMu.RLock()
+	sensor, ok := mutSensors[sensorType]
+	sensorTablesMu.RUnlock()
+	if !ok {
+		return SensorValue{}, fmt.Errorf("%w 0x%02X", errMutUnknownSensor, sensorType)
+	}
 	result := sensor.conversionFunction(sensorValue)
-	return SensorValue{sensor.name, "mut-sensor", 0, result, sensor.unit}
+	return SensorValue{sensor.name, "mut-sensor", 0, result, sensor.unit}, nil
+}
+
+// A sensor's name for the log, or its ID if the profile no longer has it
+func mutSensorName(sensorId uint16) string {
+	sensorTablesMu.RLock()
+	defer sensorTablesMu.RUnlock()
+	if sensor, ok := mutSensors[sensorId]; ok {
+		return sensor.name
+	}
+	return fmt.Sprintf("0x%02X", sensorId)
 }
 
 // IMFD sensors
@@ -729,184 +572,115 @@ type imfdSensor struct {
 	name               string
 	unit               string
 	conversionFunction func(float64) float64
+	min                float64
+	max                float64
+	decimals           int
 }
 
-var imfdSensors = map[int]imfdSensor{
-	0: {
-		"Wide-Band Air/Fuel",
-		"Lambda",
-		func(sensorValue float64) float64 { return (sensorValue/3.75 + 68) / 100 },
-	},
-	1: {
-		"Exhaust Gas Temperature",
-		"°C",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	2: {
-		"Fluid Temperature",
-		"°C",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	3: {
-		"Vacuum",
-		"mm/Hg",
-		func(sensorValue float64) float64 { return sensorValue*2.23 + 760.4 },
-	},
-	4: {
-		"Boost",
-		"Bar",
-		func(sensorValue float64) float64 { return (sensorValue / 329.48) * 0.0689476 },
-	},
-	5: {
-		"Air Intake Temperature",
-		"°C",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	6: {
-		"RPM",
-		"RPM",
-		func(sensorValue float64) float64 { return sensorValue * 19.55 },
-	},
-	7: {
-		"Vehicle Speed",
-		"km/h",
-		func(sensorValue float64) float64 { return sensorValue / 3.97 },
-	},
-	8: {
-		"Throttle Position",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	9: {
-		"Engine Load",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	10: {
-		"Fuel Pressure",
-		"Bar",
-		func(sensorValue float64) float64 { return sensorValue / 74.22 },
-	},
-	11: {
-		"Timing",
-		"°",
-		func(sensorValue float64) float64 { return sensorValue - 64 },
-	},
-	12: {
-		"MAP",
-		"kPa",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	13: {
-		"MAF",
-		"g/s",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	14: {
-		"Short Term Fuel Trim",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue - 100 },
-	},
-	15: {
-		"Long Term Fuel Trim",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue - 100 },
-	},
-	16: {
-		"Narrow-Band Oxygen Sensor",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	17: {
-		"Fuel Level",
-		"%",
-		func(sensorValue float64) float64 { return sensorValue },
-	},
-	18: {
-		"Volt Meter",
-		"V",
-		func(sensorValue float64) float64 { return sensorValue / 51.15 },
-	},
-	19: {
-		"Knock",
-		"V",
-		func(sensorValue float64) float64 { return sensorValue / 204.6 },
-	},
-	20: {
-		"Duty Cycle",
-		"+ Duty",
-		func(sensorValue float64) float64 { return sensorValue / 10.23 },
-	},
-}
+// The iMFD sensor table, built from the sensor profile at startup
+var imfdSensors map[int]imfdSensor
 
-func imfdStream() {
+// This is the main loop for the iMFD stream, it keeps the port open
+// (reopening it with a growing delay if it goes away) until ctx is cancelled
+func imfdStream(ctx context.Context, portName string, out chan<- SensorValue) {
 	log.Println("IMFD thread started")
+	backoff := mutReconnectMinBackoff
+	for {
+		reportLinkStatus(linkStatus{"imfd", linkConnecting, portName})
+
+		connected, err := imfdSession(ctx, portName, out)
+		if ctx.Err() != nil {
+			reportLinkStatus(linkStatus{"imfd", linkDown, "stopped"})
+			return
+		}
+		if connected {
+			backoff = mutReconnectMinBackoff
+		}
+		reportLinkStatus(linkStatus{"imfd", linkDown, fmt.Sprintf("%v, retrying in %s", err, backoff)})
+
+		if !sleepContext(ctx, backoff) {
+			reportLinkStatus(linkStatus{"imfd", linkDown, "stopped"})
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// Read frames from the port until it fails or ctx is cancelled.
+// Returns whether any good frames came through, and what ended the session.
+func imfdSession(ctx context.Context, portName string, out chan<- SensorValue) (bool, error) {
 	serialMode := &serial.Mode{
 		BaudRate: 19200,
 		DataBits: 8,
 		StopBits: serial.OneStopBit,
 		Parity:   serial.NoParity,
 	}
-	s, err := serial.Open("/dev/ttyS0", serialMode)
+	s, err := serial.Open(portName, serialMode)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
-	for {
-		reader := bufio.NewReader(s)
-		reply, err := reader.ReadBytes('@')
-		if err != nil {
-			log.Fatal(err)
-		}
-		if len(reply) >= 7 {
-			// Start at an offset (to ignore the start bit)
-			i := 1
-			// Finish one from the end (to ignore the stop bit)
-			to := len(reply) - 2
-
-			for i < to {
-				last := i + 5
-
-				// Pluck out the Sensor Data
-				sensorPacket := reply[i:last]
-
-				// Grab the Sensor ID
-				addr := (sensorPacket[0] << 6) | sensorPacket[1]
-				sensorType := int(addr)
-
-				// The sensor instance ID (If you have multiple sensors)
-				instance := int(sensorPacket[2])
-
-				// And the sensor value
-				sensorValueB := (sensorPacket[3] << 6) | sensorPacket[4]
-				sensorValue, err := strconv.ParseFloat(strconv.Itoa(int(sensorValueB)), 64)
-				if err != nil {
-					log.Fatal(err)
-				}
+	defer s.Close()
 
-				// Decode the packet back into a struct
-				decodedData := imfdSensorDecode(sensorType, sensorValue, instance)
+	// Time out reads so a quiet bus (or being stopped) is noticed
+	if err := s.SetReadTimeout(imfdSilenceTimeout); err != nil {
+		return false, err
+	}
 
-				// Send the decoded data to the channel
-				sensorDataChannel <- decodedData
+	if activeCapture != nil {
+		activeCapture.record("imfd", captureOpen, nil, portName)
+		defer activeCapture.record("imfd", captureClose, nil, "")
+	}
 
-				log.Printf("Event Fired: %s", decodedData.SensorLabel)
+	// One reader for the life of the port, so nothing buffered is lost between frames
+	parser := newImfdFrameParser(imfdSilenceReader{s}, activeCapture)
+	return imfdReadFrames(ctx, parser, portName, out)
+}
 
-				// Increment the for loop, so we can get to the next sensor in the chain
-				i = last
+// Decode frames and pass the readings on until the stream fails or ctx is cancelled,
+// keeping the link status up to date. Returns whether any good frames came through,
+// and what ended it.
+func imfdReadFrames(ctx context.Context, parser *imfdFrameParser, portName string, out chan<- SensorValue) (bool, error) {
+	lastReport := time.Now()
+	state := linkConnecting
+	for ctx.Err() == nil {
+		packets, err := parser.next()
+		if errors.Is(err, errImfdSilent) {
+			if state != linkDegraded {
+				state = linkDegraded
+				reportLinkStatus(linkStatus{"imfd", state, fmt.Sprintf("no frames for %s", imfdSilenceTimeout)})
 			}
-		} else {
-			fmt.Printf("Malformed frame detected (runt): %s\n", reply)
+			continue
 		}
-	}
-}
+		if err != nil {
+			return parser.stats.good > 0, err
+		}
+		if state != linkUp {
+			state = linkUp
+			reportLinkStatus(linkStatus{"imfd", state, portName})
+		}
+
+		for _, packet := range packets {
+			// Decode the packet back into a struct
+			decodedData, err := imfdSensorDecode(packet)
+			if err != nil {
+				log.Printf("[IMFD] Skipping packet: %v", err)
+				continue
+			}
 
-// Decode the sensor response from the IMFD into a struct, and perform any necessary conversions
-func imfdSensorDecode(sensorType int, sensorValue float64, instanceId int) SensorValue {
-	var result float64
-	var unit string
+			// Send the decoded data to the channel
+			select {
+			case out <- decodedData:
+			case <-ctx.Done():
+				return parser.stats.good > 0, ctx.Err()
+			}
 
-	sensorName := imfdSensors[sensorType].name
-	sensorLabel := fmt.Sprintf("/imfd-sensor/%s", sensorName)
+			log.Printf("Event Fired: %s", decodedData.SensorLabel)
+		}
 
-	return SensorValue{sensorLabel, imfdSensors[sensorType].name, instanceId, result, unit}
+		if time.Since(lastReport) >= imfdStatsInterval {
+			reportImfdStats(parser.stats)
+			lastReport = time.Now()
+		}
+	}
+	return parser.stats.good > 0, ctx.Err()
 }
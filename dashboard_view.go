@@ -0,0 +1,600 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+)
+
+// A widget showing the values of a channel
+type channelWidget interface {
+	ui.Drawable
+	show(value SensorValue)
+
+	// Recolour it while one of its channels is in alarm
+	setAlarm(level alarmLevel)
+}
+
+// A widget drawn from the history (or stats) of its channels, which is redrawn
+// as time goes by (every graphRedrawInterval) rather than with each value
+type historyWidget interface {
+	channelWidget
+	update(history *channelHistory, now time.Time)
+}
+
+// How often the graphs move along
+const graphRedrawInterval = 250 * time.Millisecond
+
+// A kind of channel widget a layout can use
+type dashboardWidgetType struct {
+	new func(spec *layoutWidget) channelWidget
+
+	// Whether it can show more than one channel
+	multiChannel bool
+}
+
+// The kinds of channel widget, by their type in the layout
+var dashboardWidgetTypes = map[string]dashboardWidgetType{
+	"gauge":     {newGaugeWidget, false},
+	"text":      {newTextWidget, false},
+	"plot":      {newPlotWidget, true},
+	"sparkline": {newSparklineWidget, true},
+	"stat":      {newStatWidget, false},
+	"stats":     {newStatsTable, true},
+}
+
+// The range a widget shows a channel over, the profile's unless the layout gives its own
+func widgetRange(spec *layoutWidget, definition channelRange, known bool) (float64, float64) {
+	low, high := 0.0, 100.0
+	if known && definition.max > definition.min {
+		low, high = definition.min, definition.max
+	}
+	if spec.Min != nil {
+		low = *spec.Min
+	}
+	if spec.Max != nil {
+		high = *spec.Max
+	}
+	return low, high
+}
+
+// How far a value is from the bottom of a range to the top, as a percentage.
+// NaN would sail straight through min and max, so anything that isn't a number is 0.
+func rangePercent(value float64, low float64, high float64) float64 {
+	if high <= low || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0
+	}
+	return min(max(100*(value-low)/(high-low), 0), 100)
+}
+
+// The colours a widget changes while its channel is in alarm, and what
+// to put them back to once it clears
+type alarmStyle struct {
+	colours []*ui.Color
+	normal  []ui.Color
+}
+
+// Remember the colours as they are now, with the layout's colours applied
+func newAlarmStyle(colours ...*ui.Color) alarmStyle {
+	normal := make([]ui.Color, len(colours))
+	for i, colour := range colours {
+		normal[i] = *colour
+	}
+	return alarmStyle{colours, normal}
+}
+
+func (s *alarmStyle) setAlarm(level alarmLevel) {
+	for i, colour := range s.colours {
+		*colour = s.normal[i]
+		if level > alarmClear {
+			*colour = level.colour()
+		}
+	}
+}
+
+// How a widget writes a value out: the number in the layout's format (or with
+// the profile's decimals), followed by the unit unless the layout gives another
+type valueFormat struct {
+	format string
+	unit   *string
+}
+
+func newValueFormat(spec *layoutWidget, definition channelRange, known bool) valueFormat {
+	format := spec.Format
+	if format == "" {
+		format = "%.1f"
+		if known {
+			format = fmt.Sprintf("%%.%df", definition.decimals)
+		}
+	}
+	return valueFormat{format, spec.Unit}
+}
+
+func (f valueFormat) text(value SensorValue) string {
+	unit := value.SensorUnit
+	if f.unit != nil {
+		unit = *f.unit
+	}
+	text := fmt.Sprintf(f.format, value.SensorValue)
+	if unit != "" {
+		text += " " + unit
+	}
+	return text
+}
+
+// A bar that fills from the channel's min to its max
+type gaugeWidget struct {
+	*widgets.Gauge
+	valueFormat
+	alarmStyle
+	min float64
+	max float64
+}
+
+func newGaugeWidget(spec *layoutWidget) channelWidget {
+	definition, known := channelDefinition(spec.key())
+	g := &gaugeWidget{Gauge: widgets.NewGauge(), valueFormat: newValueFormat(spec, definition, known)}
+	g.min, g.max = widgetRange(spec, definition, known)
+
+	g.Title = spec.title()
+	g.Label = "N/A"
+	g.BarColor = ui.ColorRed
+	g.BorderStyle.Fg = ui.ColorWhite
+	g.LabelStyle.Fg = ui.ColorCyan
+	applyLayoutColour(&g.BarColor, spec.Colour)
+	applyLayoutColour(&g.LabelStyle.Fg, spec.LabelColour)
+	applyLayoutColour(&g.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&g.BorderStyle.Fg, spec.BorderColour)
+	g.alarmStyle = newAlarmStyle(&g.BorderStyle.Fg, &g.TitleStyle.Fg, &g.LabelStyle.Fg)
+	return g
+}
+
+func (g *gaugeWidget) show(value SensorValue) {
+	g.Percent = int(rangePercent(value.SensorValue, g.min, g.max))
+	g.Label = g.text(value)
+}
+
+// Just the value, written out
+type textWidget struct {
+	*widgets.Paragraph
+	valueFormat
+	alarmStyle
+}
+
+func newTextWidget(spec *layoutWidget) channelWidget {
+	definition, known := channelDefinition(spec.key())
+	t := &textWidget{Paragraph: widgets.NewParagraph(), valueFormat: newValueFormat(spec, definition, known)}
+	t.Title = spec.title()
+	t.Text = "N/A"
+	t.BorderStyle.Fg = ui.ColorBlack
+	applyLayoutColour(&t.TextStyle.Fg, spec.Colour)
+	applyLayoutColour(&t.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&t.BorderStyle.Fg, spec.BorderColour)
+	t.alarmStyle = newAlarmStyle(&t.BorderStyle.Fg, &t.TitleStyle.Fg, &t.TextStyle.Fg)
+	return t
+}
+
+func (t *textWidget) show(value SensorValue) {
+	t.Text = t.text(value)
+}
+
+// The colours graphs go through for channels the layout doesn't give one
+var graphColours = []string{"green", "yellow", "cyan", "magenta", "red", "blue", "white"}
+
+// One channel on a graph (or in a stats table)
+type graphSeries struct {
+	key    string
+	name   string
+	colour string
+	min    float64
+	max    float64
+	valueFormat
+
+	// The unit in the profile, graphs having no SensorValue to hand to take it from
+	profileUnit string
+}
+
+func newGraphSeries(spec *layoutWidget) []graphSeries {
+	series := make([]graphSeries, len(spec.keys))
+	for i, key := range spec.keys {
+		definition, known := channelDefinition(key)
+		_, name := splitChannelKey(key)
+		colour := graphColours[i%len(graphColours)]
+		if i < len(spec.Colours) {
+			colour = strings.ToLower(spec.Colours[i])
+		}
+		low, high := widgetRange(spec, definition, known)
+		series[i] = graphSeries{key, name, colour, low, high, newValueFormat(spec, definition, known), definition.unit}
+	}
+	return series
+}
+
+// The channel over the window up to now, in n steps, as percentages of its range
+func (s *graphSeries) percentages(history *channelHistory, from time.Time, to time.Time, n int) []float64 {
+	values, first := resample(history.ring(s.key).since(from), from, to, n)
+	for i := first; i < n; i++ {
+		values[i] = rangePercent(values[i], s.min, s.max)
+	}
+	return values
+}
+
+// The channel's name and latest value
+func (s *graphSeries) latest(history *channelHistory) string {
+	sample, ok := history.ring(s.key).last()
+	if !ok {
+		return s.name + " N/A"
+	}
+	return s.name + " " + s.text(SensorValue{SensorValue: sample.value, SensorUnit: s.profileUnit})
+}
+
+// The channel's latest value
+func (s *graphSeries) now(history *channelHistory) string {
+	sample, ok := history.ring(s.key).last()
+	if !ok {
+		return "N/A"
+	}
+	return s.text(SensorValue{SensorValue: sample.value, SensorUnit: s.profileUnit})
+}
+
+// One of the channel's stats, written out
+func (s *graphSeries) statistic(history *channelHistory, stat string, samples int, threshold *float64) string {
+	stats, ok := history.stats[s.key]
+	if !ok || stats.count == 0 {
+		return "N/A"
+	}
+	value := func(v float64) string {
+		return s.text(SensorValue{SensorValue: v, SensorUnit: s.profileUnit})
+	}
+	switch stat {
+	case "min":
+		return value(stats.min)
+	case "max":
+		return value(stats.max)
+	case "mean":
+		return value(stats.mean())
+	case "average":
+		average, _ := history.average(s.key, samples)
+		return value(average)
+	case "above":
+		if threshold != nil {
+			return stats.above[*threshold].Round(100 * time.Millisecond).String()
+		}
+	}
+	return ""
+}
+
+// What's on a graph and how far back it goes, for its title
+func graphTitle(spec *layoutWidget, legend string) string {
+	title := "last " + spec.window().String()
+	if legend != "" {
+		title = legend + " · " + title
+	}
+	if spec.Title != "" {
+		title = spec.Title + ": " + title
+	}
+	return title
+}
+
+// A line for each channel across the window, scrolling left as time goes by
+type plotWidget struct {
+	*widgets.Plot
+	alarmStyle
+	spec   *layoutWidget
+	series []graphSeries
+}
+
+func newPlotWidget(spec *layoutWidget) channelWidget {
+	p := &plotWidget{Plot: widgets.NewPlot(), spec: spec, series: newGraphSeries(spec)}
+	// Every channel is drawn over its own range, so an axis would only be right for one of them
+	p.ShowAxes = false
+	p.MaxVal = 100
+	p.LineColors = nil
+	for _, s := range p.series {
+		p.LineColors = append(p.LineColors, layoutColours[s.colour])
+	}
+	p.BorderStyle.Fg = ui.ColorWhite
+	applyLayoutColour(&p.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&p.BorderStyle.Fg, spec.BorderColour)
+	p.alarmStyle = newAlarmStyle(&p.BorderStyle.Fg, &p.TitleStyle.Fg)
+	p.Title = spec.Title
+	return p
+}
+
+// Graphs are drawn from the history instead, as they move along
+func (p *plotWidget) show(value SensorValue) {}
+
+func (p *plotWidget) update(history *channelHistory, now time.Time) {
+	// A point for every column, and a line needs at least two
+	n := max(p.Inner.Dx(), 2)
+	from := now.Add(-p.spec.window())
+	p.Data = p.Data[:0]
+	legend := make([]string, len(p.series))
+	for i := range p.series {
+		p.Data = append(p.Data, p.series[i].percentages(history, from, now, n))
+		legend[i] = p.series[i].latest(history) + " (" + p.series[i].colour + ")"
+	}
+	p.Title = graphTitle(p.spec, strings.Join(legend, ", "))
+}
+
+// A sparkline for each channel, one above the other, with its latest value
+type sparklineWidget struct {
+	*widgets.SparklineGroup
+	alarmStyle
+	spec   *layoutWidget
+	series []graphSeries
+}
+
+func newSparklineWidget(spec *layoutWidget) channelWidget {
+	s := &sparklineWidget{SparklineGroup: widgets.NewSparklineGroup(), spec: spec, series: newGraphSeries(spec)}
+	for _, series := range s.series {
+		line := widgets.NewSparkline()
+		line.MaxVal = 100
+		line.LineColor = layoutColours[series.colour]
+		line.TitleStyle.Fg = line.LineColor
+		s.Sparklines = append(s.Sparklines, line)
+	}
+	s.BorderStyle.Fg = ui.ColorWhite
+	applyLayoutColour(&s.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&s.BorderStyle.Fg, spec.BorderColour)
+	s.alarmStyle = newAlarmStyle(&s.BorderStyle.Fg, &s.TitleStyle.Fg)
+	s.Title = graphTitle(spec, "")
+	return s
+}
+
+func (s *sparklineWidget) show(value SensorValue) {}
+
+func (s *sparklineWidget) update(history *channelHistory, now time.Time) {
+	n := max(s.Inner.Dx(), 1)
+	from := now.Add(-s.spec.window())
+	for i, line := range s.Sparklines {
+		line.Data = s.series[i].percentages(history, from, now, n)
+		line.Title = s.series[i].latest(history)
+	}
+}
+
+// One of a channel's stats, written out like a text widget's value
+type statWidget struct {
+	*widgets.Paragraph
+	alarmStyle
+	spec   *layoutWidget
+	series graphSeries
+}
+
+func newStatWidget(spec *layoutWidget) channelWidget {
+	s := &statWidget{Paragraph: widgets.NewParagraph(), spec: spec, series: newGraphSeries(spec)[0]}
+	s.Title = spec.Title
+	if s.Title == "" {
+		s.Title = s.series.name + " " + statNames[spec.Stat]
+		switch spec.Stat {
+		case "average":
+			s.Title += fmt.Sprintf(" of %d", spec.samples())
+		case "above":
+			s.Title += fmt.Sprintf(" %g", *spec.Threshold)
+		}
+	}
+	s.Text = "N/A"
+	s.BorderStyle.Fg = ui.ColorBlack
+	applyLayoutColour(&s.TextStyle.Fg, spec.Colour)
+	applyLayoutColour(&s.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&s.BorderStyle.Fg, spec.BorderColour)
+	s.alarmStyle = newAlarmStyle(&s.BorderStyle.Fg, &s.TitleStyle.Fg, &s.TextStyle.Fg)
+	return s
+}
+
+// Stats are kept with the history, so they're drawn from there like the graphs
+func (s *statWidget) show(value SensorValue) {}
+
+func (s *statWidget) update(history *channelHistory, now time.Time) {
+	s.Text = s.series.statistic(history, s.spec.Stat, s.spec.samples(), s.spec.Threshold)
+}
+
+// All the stats for each of its channels, a row each
+type statsTable struct {
+	*widgets.Table
+	alarmStyle
+	spec       *layoutWidget
+	series     []graphSeries
+	thresholds []*float64
+	header     []string
+}
+
+func newStatsTable(spec *layoutWidget) channelWidget {
+	t := &statsTable{Table: widgets.NewTable(), spec: spec, series: newGraphSeries(spec), thresholds: spec.thresholds()}
+	t.header = []string{"", "now", "min", "max", "mean", fmt.Sprintf("avg of %d", spec.samples())}
+	for _, threshold := range t.thresholds {
+		if threshold != nil {
+			t.header = append(t.header, "time over")
+			break
+		}
+	}
+	t.Rows = [][]string{t.header}
+	t.RowSeparator = false
+	t.RowStyles[0] = ui.NewStyle(ui.ColorWhite, ui.ColorClear, ui.ModifierBold)
+	// The names need more room than the numbers
+	t.ColumnResizer = func() {
+		columns := len(t.header)
+		width := max((t.Inner.Dx()-columns+1)/(columns+1), 1)
+		t.ColumnWidths = make([]int, columns)
+		for i := range t.ColumnWidths {
+			t.ColumnWidths[i] = width
+		}
+		t.ColumnWidths[0] = max(t.Inner.Dx()-(columns-1)*(width+1), width)
+	}
+	t.BorderStyle.Fg = ui.ColorWhite
+	applyLayoutColour(&t.TextStyle.Fg, spec.Colour)
+	applyLayoutColour(&t.TitleStyle.Fg, spec.TitleColour)
+	applyLayoutColour(&t.BorderStyle.Fg, spec.BorderColour)
+	t.alarmStyle = newAlarmStyle(&t.BorderStyle.Fg, &t.TitleStyle.Fg)
+	return t
+}
+
+func (t *statsTable) show(value SensorValue) {}
+
+func (t *statsTable) update(history *channelHistory, now time.Time) {
+	t.Rows = [][]string{t.header}
+	for i := range t.series {
+		s := &t.series[i]
+		row := []string{s.name, s.now(history)}
+		for _, stat := range []string{"min", "max", "mean", "average"} {
+			row = append(row, s.statistic(history, stat, t.spec.samples(), nil))
+		}
+		if len(t.header) > 6 && t.thresholds[i] != nil {
+			row = append(row, fmt.Sprintf("%s over %g", s.statistic(history, "above", 0, t.thresholds[i]), *t.thresholds[i]))
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	t.Title = "since " + history.statsSince.Format("15:04:05") + ", r to reset"
+	if t.spec.Title != "" {
+		t.Title = t.spec.Title + ": " + t.Title
+	}
+}
+
+// What a link widget shows: the state of the link, coloured by how it's doing,
+// then whatever else we know about it. Kept by the dashboard so it survives the
+// layout changing.
+type linkDisplay struct {
+	state  string
+	colour ui.Color
+	detail []string
+}
+
+func (d *linkDisplay) text() string {
+	return strings.Join(append([]string{d.state}, d.detail...), "\n")
+}
+
+// The widgets a layout puts on screen, and what each of them shows
+type dashboardView struct {
+	grid *ui.Grid
+
+	// Channel widgets by the key of their channel, link widgets by their source
+	widgets map[string][]channelWidget
+	links   map[string][]*widgets.Paragraph
+
+	// The channels each widget shows, and the widgets that need redrawing as time goes by
+	keys   map[channelWidget][]string
+	graphs []historyWidget
+}
+
+// Build the widgets for a page of the layout and put them on a grid, with any
+// extras across the top (the alarm banner) and bottom (the playback position, say)
+func newDashboardView(page *layoutPage, top []ui.Drawable, bottom []ui.Drawable) *dashboardView {
+	view := &dashboardView{
+		grid:    ui.NewGrid(),
+		widgets: make(map[string][]channelWidget),
+		links:   make(map[string][]*widgets.Paragraph),
+		keys:    make(map[channelWidget][]string),
+	}
+
+	// Rows (and the widgets in them) get their share of the space by their height (and width)
+	total := float64(len(top) + len(bottom))
+	for _, row := range page.Rows {
+		total += row.Height
+	}
+
+	var rows []interface{}
+	for _, extra := range top {
+		rows = append(rows, ui.NewRow(1/total, ui.NewCol(1, extra)))
+	}
+	for _, row := range page.Rows {
+		width := 0.0
+		for _, spec := range row.Widgets {
+			width += spec.Width
+		}
+		var cols []interface{}
+		for i := range row.Widgets {
+			spec := &row.Widgets[i]
+			cols = append(cols, ui.NewCol(spec.Width/width, view.add(spec)))
+		}
+		rows = append(rows, ui.NewRow(row.Height/total, cols...))
+	}
+	for _, extra := range bottom {
+		rows = append(rows, ui.NewRow(1/total, ui.NewCol(1, extra)))
+	}
+	view.grid.Set(rows...)
+	return view
+}
+
+func (view *dashboardView) add(spec *layoutWidget) ui.Drawable {
+	if spec.Type == "link" {
+		link := widgets.NewParagraph()
+		link.Title = spec.Title
+		link.BorderStyle.Fg = ui.ColorBlack
+		applyLayoutColour(&link.TitleStyle.Fg, spec.TitleColour)
+		applyLayoutColour(&link.BorderStyle.Fg, spec.BorderColour)
+		view.links[spec.Source] = append(view.links[spec.Source], link)
+		return link
+	}
+	widget := dashboardWidgetTypes[spec.Type].new(spec)
+	for _, key := range spec.keys {
+		view.widgets[key] = append(view.widgets[key], widget)
+	}
+	view.keys[widget] = spec.keys
+	if graph, ok := widget.(historyWidget); ok {
+		view.graphs = append(view.graphs, graph)
+	}
+	return widget
+}
+
+// Show a new value on every widget for its channel
+func (view *dashboardView) show(value SensorValue) {
+	for _, widget := range view.widgets["/"+value.SensorType+"/"+value.SensorLabel] {
+		widget.show(value)
+		ui.Render(widget)
+	}
+}
+
+// Recolour the widgets for any channel in alarm, a widget with more than one channel going by the worst of them
+func (view *dashboardView) setAlarms(levels map[string]alarmLevel) {
+	for widget, keys := range view.keys {
+		level := alarmClear
+		for _, key := range keys {
+			level = max(level, levels[key])
+		}
+		widget.setAlarm(level)
+	}
+}
+
+// Move the graphs along to now, and bring the stats up to date
+func (view *dashboardView) redrawGraphs(history *channelHistory, now time.Time) {
+	for _, graph := range view.graphs {
+		graph.update(history, now)
+		ui.Render(graph)
+	}
+}
+
+// Show how a source's link is doing on its link widgets
+func (view *dashboardView) showLink(source string, display *linkDisplay) {
+	for _, link := range view.links[source] {
+		link.Text = display.text()
+		link.TextStyle.Fg = display.colour
+		ui.Render(link)
+	}
+}
+
+// A one line tab bar with the pages and the number key for each
+func newPageTabs(layout *dashboardLayout) *widgets.TabPane {
+	names := make([]string, len(layout.Pages))
+	for i, page := range layout.Pages {
+		names[i] = fmt.Sprintf("%d %s", i+1, page.Name)
+	}
+	tabs := widgets.NewTabPane(names...)
+	// Without the border the tabs can have the whole of their one line
+	tabs.Border = false
+	tabs.PaddingTop, tabs.PaddingBottom, tabs.PaddingLeft, tabs.PaddingRight = -1, -1, -1, -1
+	return tabs
+}
+
+// The channels on screen, for the MUT scheduler to poll first
+func (view *dashboardView) channels() []string {
+	keys := make([]string, 0, len(view.widgets))
+	for key := range view.widgets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// How badly a subscriber wants a channel, the scheduler polls
+// each sensor according to the strongest demand for it
+type demandLevel int
+
+const (
+	demandNone demandLevel = iota
+	// Written to a log, so it should keep to its usual rate
+	demandLogged
+	// Watched by an alarm, which shouldn't be left waiting
+	demandAlarm
+	// On screen right now, so it gets all the bandwidth we can give it
+	demandVisible
+)
+
+func (l demandLevel) String() string {
+	switch l {
+	case demandLogged:
+		return "logged"
+	case demandAlarm:
+		return "alarm"
+	case demandVisible:
+		return "visible"
+	}
+	return "none"
+}
+
+// Keeps track of which channels the widgets, loggers and alarms want,
+// so the MUT scheduler can spend the bus on the sensors somebody is looking at
+type channelDemand struct {
+	mu          sync.Mutex
+	subscribers map[string]subscription
+
+	// Closed and replaced every time the demand changes, to wake up anyone waiting on it
+	changedCh chan struct{}
+}
+
+type subscription struct {
+	level demandLevel
+	keys  []string
+}
+
+var sensorDemand = newChannelDemand()
+
+func newChannelDemand() *channelDemand {
+	return &channelDemand{
+		subscribers: make(map[string]subscription),
+		changedCh:   make(chan struct{}),
+	}
+}
+
+// Replace what a subscriber wants with the given channel keys ("/mut-sensor/Engine RPM")
+func (d *channelDemand) set(subscriber string, level demandLevel, keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribers[subscriber] = subscription{level, append([]string(nil), keys...)}
+	d.notify()
+}
+
+// Forget a subscriber altogether, when a logger stops or a page closes
+func (d *channelDemand) clear(subscriber string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, exists := d.subscribers[subscriber]; !exists {
+		return
+	}
+	delete(d.subscribers, subscriber)
+	d.notify()
+}
+
+// Must be called with the lock held
+func (d *channelDemand) notify() {
+	close(d.changedCh)
+	d.changedCh = make(chan struct{})
+}
+
+// A channel that is closed the next time the demand changes
+func (d *channelDemand) changed() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.changedCh
+}
+
+// The strongest demand for every channel anybody wants, and whether anybody has
+// subscribed at all (if not there's nothing to go on, so everything is wanted)
+func (d *channelDemand) snapshot() (map[string]demandLevel, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	levels := make(map[string]demandLevel)
+	for _, subscription := range d.subscribers {
+		for _, key := range subscription.keys {
+			if subscription.level > levels[key] {
+				levels[key] = subscription.level
+			}
+		}
+	}
+	return levels, len(d.subscribers) > 0
+}
+
+// Who is subscribed, for the log
+func (d *channelDemand) subscriberNames() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.subscribers))
+	for name := range d.subscribers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Every profile we ship with, which are matched against the ECU when no profile is given
+//
+//go:embed profiles/*.json
+var builtInProfiles embed.FS
+
+// The profile used when the ECU doesn't match any other. It's the full sensor set,
+// same as we always polled before profiles were picked by ECU: a request an ECU
+// doesn't answer only costs a timeout, whereas leaving boost and friends off the
+// dashboard on every car we haven't got an ID for would make it next to useless.
+const fallbackProfileName = "default"
+
+// Requests that return the ECU ID Type and Version, which together make up the ROM ID
+const (
+	mutRequestRomIdType    byte = 0x80
+	mutRequestRomIdVersion byte = 0x82
+)
+
+// Who the ECU says it is, from the handshake and the ROM ID requests
+type ecuIdentity struct {
+	ecuId uint16
+	romId uint16
+
+	// Not every ECU answers the ROM ID requests
+	hasRomId bool
+}
+
+func (id ecuIdentity) String() string {
+	if !id.hasRomId {
+		return fmt.Sprintf("ECU %04X", id.ecuId)
+	}
+	return fmt.Sprintf("ECU %04X ROM %04X", id.ecuId, id.romId)
+}
+
+// Ask the ECU for its ROM ID, now that the handshake has given us the ECU ID.
+// An ECU that doesn't answer is fine, anything worse means the link is gone.
+func mutReadRomId(transport ecuTransport, codec mutCodec, id *ecuIdentity) error {
+	var romId uint16
+	for _, request := range []byte{mutRequestRomIdType, mutRequestRomIdVersion} {
+		b, err := mutExchange(transport, codec, request)
+		if err != nil {
+			if classifyMutError(err) == mutFaultUnplugged {
+				return err
+			}
+			log.Printf("ECU didn't answer ROM ID request 0x%02X: %v", request, err)
+			return transport.Purge()
+		}
+		romId = romId<<8 | uint16(b)
+	}
+	id.romId, id.hasRomId = romId, true
+	return nil
+}
+
+// The ECU and ROM IDs a profile is for, written as four hex digits ("4D53")
+type profileMatch struct {
+	EcuIds []string `json:"ecuIds,omitempty"`
+	RomIds []string `json:"romIds,omitempty"`
+}
+
+func parseEcuId(text string) (uint16, error) {
+	text = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(text)), "0x")
+	if len(text) != 4 {
+		return 0, fmt.Errorf("%q should be four hex digits", text)
+	}
+	id, err := strconv.ParseUint(text, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%q should be four hex digits", text)
+	}
+	return uint16(id), nil
+}
+
+func (m *profileMatch) check() []error {
+	var problems []error
+	for _, text := range m.EcuIds {
+		if _, err := parseEcuId(text); err != nil {
+			problems = append(problems, fmt.Errorf("match: ECU id %w", err))
+		}
+	}
+	for _, text := range m.RomIds {
+		if _, err := parseEcuId(text); err != nil {
+			problems = append(problems, fmt.Errorf("match: ROM id %w", err))
+		}
+	}
+	return problems
+}
+
+// How well the identity matches: 2 for the ROM ID (which pins down the exact
+// calibration), 1 for just the ECU ID and 0 for no match at all
+func (m *profileMatch) score(id ecuIdentity) int {
+	if m == nil {
+		return 0
+	}
+	if id.hasRomId {
+		for _, text := range m.RomIds {
+			if romId, err := parseEcuId(text); err == nil && romId == id.romId {
+				return 2
+			}
+		}
+	}
+	for _, text := range m.EcuIds {
+		if ecuId, err := parseEcuId(text); err == nil && ecuId == id.ecuId {
+			return 1
+		}
+	}
+	return 0
+}
+
+// The built-in profiles, compiled and ready to be swapped in once we know which ECU we have
+type ecuProfileRegistry struct {
+	profiles []*sensorTables
+	fallback *sensorTables
+}
+
+// Set when the profile should be picked from the ECU ID, nil if one was given on the command line
+var profileRegistry *ecuProfileRegistry
+
+// Read and check every built-in profile, so a broken one is caught at startup
+// rather than when the car it's for is plugged in
+func loadProfileRegistry() (*ecuProfileRegistry, error) {
+	entries, err := builtInProfiles.ReadDir("profiles")
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &ecuProfileRegistry{}
+	names := make(map[string]string)
+	for _, entry := range entries {
+		file := path.Join("profiles", entry.Name())
+		data, err := builtInProfiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := parseSensorProfile(data, file)
+		if err != nil {
+			return nil, err
+		}
+		tables, err := profile.compile()
+		if err != nil {
+			return nil, err
+		}
+		if previous, exists := names[profile.Name]; exists {
+			return nil, fmt.Errorf("%s: profile name %q is already used by %s", file, profile.Name, previous)
+		}
+		names[profile.Name] = file
+
+		if profile.Name == fallbackProfileName {
+			registry.fallback = tables
+		}
+		registry.profiles = append(registry.profiles, tables)
+	}
+
+	if registry.fallback == nil {
+		return nil, fmt.Errorf("no %q profile built in", fallbackProfileName)
+	}
+	return registry, nil
+}
+
+// Find the profile that best matches the ECU, falling back to the full one
+func (r *ecuProfileRegistry) lookup(id ecuIdentity) (*sensorTables, bool) {
+	best, bestScore := r.fallback, 0
+	for _, tables := range r.profiles {
+		if score := tables.profile.Match.score(id); score > bestScore {
+			best, bestScore = tables, score
+		}
+	}
+	return best, bestScore > 0
+}
+
+// Which profile is in use for the ECU we're talking to, for the dashboard to show
+type ecuProfileStatus struct {
+	identity ecuIdentity
+	profile  string
+	known    bool
+}
+
+var ecuProfileChannel = make(chan ecuProfileStatus, 4)
+
+// A line for the dashboard, unknown ECUs are highlighted since their readings may not be right
+func (s ecuProfileStatus) describe() string {
+	if !s.known {
+		return fmt.Sprintf("[Unknown %s, using %s profile](fg:yellow,mod:bold)", s.identity, s.profile)
+	}
+	return fmt.Sprintf("%s: %s", s.identity, s.profile)
+}
+
+// Switch to the profile for the ECU we've just identified, if we're picking them automatically
+func selectEcuProfile(id ecuIdentity) {
+	status := ecuProfileStatus{identity: id, known: true}
+
+	if profileRegistry != nil {
+		tables, known := profileRegistry.lookup(id)
+		sensorTablesMu.RLock()
+		active := activeProfile
+		sensorTablesMu.RUnlock()
+		if tables.profile != active {
+			tables.apply()
+		}
+		status.known = known
+		if !known {
+			log.Printf("%s isn't in any profile, falling back to the %s profile, some of its sensors may not answer or read right", id, tables.profile.Name)
+		}
+	}
+	sensorTablesMu.RLock()
+	status.profile = activeProfile.Name
+	sensorTablesMu.RUnlock()
+	log.Printf("%s, using profile %q", id, status.profile)
+
+	select {
+	case ecuProfileChannel <- status:
+	default:
+	}
+}
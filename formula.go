@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Sensor conversions are written as small expressions over the raw value x,
+// such as "x * 31.25" or "(x - 128) / 5", and compiled once when a profile is loaded.
+// The language is deliberately tiny: no variables, loops or side effects,
+// so a profile from the internet can't do anything worse than give a wrong number.
+//
+// Grammar:
+//
+//	expr    = bitor
+//	bitor   = bitand { "|" bitand }
+//	bitand  = shift { "&" shift }
+//	shift   = sum { ("<<" | ">>") sum }
+//	sum     = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | "x" | channel | call | "(" expr ")"
+//	channel = "[" [ source ":" ] name "]"
+//	call    = function "(" expr { "," expr } ")"
+//
+// Numbers may be decimal or hex (0x3F). Bit operators work on the integer part of their operands.
+// Channels refer to the latest value of another sensor, e.g. "[Engine RPM]" or "[imfd:Boost]".
+// Functions are listed in formulaFunctions, plus lookup(table, value) which
+// interpolates through one of the profile's lookup tables.
+
+// How deeply formulas can nest, so a hostile profile can't blow the stack
+const formulaMaxDepth = 64
+
+// A compiled formula, ready to be evaluated
+type formulaNode interface {
+	eval(x float64) float64
+}
+
+type formulaNumber float64
+
+func (n formulaNumber) eval(x float64) float64 { return float64(n) }
+
+type formulaRaw struct{}
+
+func (formulaRaw) eval(x float64) float64 { return x }
+
+type formulaNegate struct{ operand formulaNode }
+
+func (n formulaNegate) eval(x float64) float64 { return -n.operand.eval(x) }
+
+type formulaBinary struct {
+	op          string
+	left, right formulaNode
+}
+
+func (n formulaBinary) eval(x float64) float64 {
+	left, right := n.left.eval(x), n.right.eval(x)
+	switch n.op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	case "/":
+		return left / right
+	case "%":
+		return math.Mod(left, right)
+	case "^":
+		return math.Pow(left, right)
+	case "&":
+		return float64(int64(left) & int64(right))
+	case "|":
+		return float64(int64(left) | int64(right))
+	case "<<":
+		return float64(int64(left) << uint64(right))
+	case ">>":
+		return float64(int64(left) >> uint64(right))
+	}
+	panic("unreachable")
+}
+
+// The latest value of another channel, NaN until it has been seen
+type formulaChannel struct{ key string }
+
+func (n formulaChannel) eval(x float64) float64 {
+	if value, ok := latestValues.get(n.key); ok {
+		return value
+	}
+	return math.NaN()
+}
+
+type formulaCall struct {
+	function formulaFunction
+	args     []formulaNode
+}
+
+func (n formulaCall) eval(x float64) float64 {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.eval(x)
+	}
+	return n.function.call(args)
+}
+
+type formulaLookup struct {
+	table lookupTable
+	value formulaNode
+}
+
+func (n formulaLookup) eval(x float64) float64 {
+	return n.table.at(n.value.eval(x))
+}
+
+// A built in function, and how many arguments it takes (maxArgs < 0 means any number)
+type formulaFunction struct {
+	minArgs, maxArgs int
+	call             func(args []float64) float64
+}
+
+var formulaFunctions = map[string]formulaFunction{
+	"min": {2, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result
+	}},
+	"max": {2, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result
+	}},
+	"clamp": {3, 3, func(args []float64) float64 { return math.Max(args[1], math.Min(args[2], args[0])) }},
+	"abs":   {1, 1, func(args []float64) float64 { return math.Abs(args[0]) }},
+	"round": {1, 1, func(args []float64) float64 { return math.Round(args[0]) }},
+	"floor": {1, 1, func(args []float64) float64 { return math.Floor(args[0]) }},
+	"ceil":  {1, 1, func(args []float64) float64 { return math.Ceil(args[0]) }},
+	"sqrt":  {1, 1, func(args []float64) float64 { return math.Sqrt(args[0]) }},
+	// bit(value, n) is 1 if bit n of value is set
+	"bit": {2, 2, func(args []float64) float64 { return float64((int64(args[0]) >> uint64(args[1])) & 1) }},
+}
+
+// Describe how many arguments a function takes, for error messages
+func (f formulaFunction) arity() string {
+	switch {
+	case f.maxArgs < 0:
+		return fmt.Sprintf("at least %d arguments", f.minArgs)
+	case f.minArgs == 1 && f.maxArgs == 1:
+		return "1 argument"
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d arguments", f.minArgs)
+	}
+	return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+}
+
+// A lookup table, as a list of [input, output] points with the inputs in increasing order
+type lookupTable [][2]float64
+
+// Interpolate linearly between the points, holding the end values outside the table
+func (t lookupTable) at(x float64) float64 {
+	if math.IsNaN(x) {
+		return x
+	}
+	if x <= t[0][0] {
+		return t[0][1]
+	}
+	last := t[len(t)-1]
+	if x >= last[0] {
+		return last[1]
+	}
+
+	// First point above x, we know there's a point at or below it
+	i := sort.Search(len(t), func(i int) bool { return t[i][0] > x })
+	lower, upper := t[i-1], t[i]
+	return lower[1] + (x-lower[0])*(upper[1]-lower[1])/(upper[0]-lower[0])
+}
+
+func (t lookupTable) check() error {
+	if len(t) < 2 {
+		return fmt.Errorf("needs at least two points")
+	}
+	for i := 1; i < len(t); i++ {
+		if t[i][0] <= t[i-1][0] {
+			return fmt.Errorf("inputs must be increasing, point %d (%g) isn't after point %d (%g)", i, t[i][0], i-1, t[i-1][0])
+		}
+	}
+	return nil
+}
+
+// What a formula is allowed to refer to. A nil env allows neither channels nor tables.
+type formulaEnv struct {
+	// Which source the formula belongs to ("mut", "imfd"...), unqualified channel names look here first
+	source string
+
+	// The channel names each source has
+	channels map[string]map[string]bool
+
+	tables map[string]lookupTable
+}
+
+// Resolve a channel reference to the key its values are stored under
+func (env *formulaEnv) channel(reference string) (string, error) {
+	if env == nil {
+		return "", fmt.Errorf("channel references aren't allowed here")
+	}
+
+	source, name, qualified := strings.Cut(reference, ":")
+	if qualified {
+		source, name = strings.TrimSpace(source), strings.TrimSpace(name)
+		if !env.hasChannel(source, name) {
+			return "", fmt.Errorf("unknown channel %q", reference)
+		}
+		return channelKey(source, name), nil
+	}
+
+	name = strings.TrimSpace(reference)
+	if env.hasChannel(env.source, name) {
+		return channelKey(env.source, name), nil
+	}
+	var found []string
+	for source := range env.channels {
+		if env.hasChannel(source, name) {
+			found = append(found, source)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("unknown channel %q", name)
+	case 1:
+		return channelKey(found[0], name), nil
+	}
+	sort.Strings(found)
+	return "", fmt.Errorf("channel %q is ambiguous, qualify it with one of %s", name, strings.Join(found, ", "))
+}
+
+// Whether a source has a channel. iMFD channels can also be a numbered
+// instance of a sensor ("Exhaust Gas Temperature #2").
+func (env *formulaEnv) hasChannel(source string, name string) bool {
+	if env.channels[source][name] {
+		return true
+	}
+	if source == "imfd" {
+		if base, instance, err := splitImfdChannelName(name); err == nil && instance > 0 {
+			return env.channels[source][base]
+		}
+	}
+	return false
+}
+
+func (env *formulaEnv) table(name string) (lookupTable, bool) {
+	if env == nil {
+		return nil, false
+	}
+	table, ok := env.tables[name]
+	return table, ok
+}
+
+// Compile a formula into a conversion function, checking everything it refers to exists
+func compileFormula(source string, env *formulaEnv) (func(float64) float64, error) {
+	node, _, err := parseFormula(source, env)
+	if err != nil {
+		return nil, err
+	}
+	return node.eval, nil
+}
+
+// Compile the formula for a computed channel, which works only from other channels
+// (there's no raw value x), returning it along with the channels it refers to
+func compileComputedFormula(source string, env *formulaEnv) (func() float64, []string, error) {
+	node, p, err := parseFormula(source, env)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.raw {
+		return nil, nil, fmt.Errorf("formula %q: computed channels have no raw value x, only other channels", source)
+	}
+	if len(p.channels) == 0 {
+		return nil, nil, fmt.Errorf("formula %q doesn't refer to any channels to compute it from", source)
+	}
+	return func() float64 { return node.eval(math.NaN()) }, p.channels, nil
+}
+
+func parseFormula(source string, env *formulaEnv) (formulaNode, *formulaParser, error) {
+	p := &formulaParser{source: source, env: env}
+	p.next()
+
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.token != "" {
+		return nil, nil, p.errorf("unexpected %q", p.token)
+	}
+	return node, p, nil
+}
+
+// A simple recursive descent parser over the formula text
+type formulaParser struct {
+	source string
+	pos    int
+	env    *formulaEnv
+	depth  int
+
+	// The current token, and where it started
+	token      string
+	tokenStart int
+
+	// The keys of the channels the formula refers to, and whether it uses x
+	channels []string
+	raw      bool
+}
+
+// Move on to the next token, leaving an empty token at the end of the input
+func (p *formulaParser) next() {
+	for p.pos < len(p.source) && unicode.IsSpace(rune(p.source[p.pos])) {
+		p.pos++
+	}
+	p.tokenStart = p.pos
+	if p.pos >= len(p.source) {
+		p.token = ""
+		return
+	}
+
+	rest := p.source[p.pos:]
+	c := rune(rest[0])
+	end := 1
+	switch {
+	case strings.HasPrefix(rest, "0x") || strings.HasPrefix(rest, "0X"):
+		end = 2
+		for end < len(rest) && strings.ContainsRune("0123456789abcdefABCDEF", rune(rest[end])) {
+			end++
+		}
+	case unicode.IsDigit(c) || c == '.':
+		for end < len(rest) && (unicode.IsDigit(rune(rest[end])) || rest[end] == '.') {
+			end++
+		}
+	case unicode.IsLetter(c) || c == '_':
+		for end < len(rest) && (unicode.IsLetter(rune(rest[end])) || unicode.IsDigit(rune(rest[end])) || rest[end] == '_') {
+			end++
+		}
+	case c == '[':
+		// Channel names can have spaces and punctuation, so take everything up to the ]
+		if i := strings.IndexByte(rest, ']'); i >= 0 {
+			end = i + 1
+		} else {
+			end = len(rest)
+		}
+	case strings.HasPrefix(rest, "<<") || strings.HasPrefix(rest, ">>"):
+		end = 2
+	}
+	p.token, p.pos = rest[:end], p.pos+end
+}
+
+func (p *formulaParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.tokenStart, format, args...)
+}
+
+func (p *formulaParser) errorAt(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("formula %q at column %d: %s", p.source, pos+1, fmt.Sprintf(format, args...))
+}
+
+// Keep track of how deep we are, failing once the formula nests too far
+func (p *formulaParser) enter() error {
+	p.depth++
+	if p.depth > formulaMaxDepth {
+		return p.errorf("nested too deeply")
+	}
+	return nil
+}
+
+func (p *formulaParser) leave() {
+	p.depth--
+}
+
+// Parse a left associative chain of binary operators
+func (p *formulaParser) parseBinary(operators []string, operand func() (formulaNode, error)) (formulaNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range operators {
+			if p.token == candidate {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = formulaBinary{op, left, right}
+	}
+}
+
+func (p *formulaParser) parseExpr() (formulaNode, error) {
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	return p.parseBitOr()
+}
+
+func (p *formulaParser) parseBitOr() (formulaNode, error) {
+	return p.parseBinary([]string{"|"}, p.parseBitAnd)
+}
+
+func (p *formulaParser) parseBitAnd() (formulaNode, error) {
+	return p.parseBinary([]string{"&"}, p.parseShift)
+}
+
+func (p *formulaParser) parseShift() (formulaNode, error) {
+	return p.parseBinary([]string{"<<", ">>"}, p.parseSum)
+}
+
+func (p *formulaParser) parseSum() (formulaNode, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseTerm)
+}
+
+func (p *formulaParser) parseTerm() (formulaNode, error) {
+	return p.parseBinary([]string{"*", "/", "%"}, p.parseUnary)
+}
+
+func (p *formulaParser) parseUnary() (formulaNode, error) {
+	if p.token != "-" {
+		return p.parsePower()
+	}
+
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	p.next()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return formulaNegate{operand}, nil
+}
+
+func (p *formulaParser) parsePower() (formulaNode, error) {
+	base, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "^" {
+		return base, nil
+	}
+	p.next()
+	// Right associative, so 2^3^2 is 2^(3^2), which nests as deep as a long enough chain
+	defer p.leave()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return formulaBinary{"^", base, exponent}, nil
+}
+
+func (p *formulaParser) parsePrimary() (formulaNode, error) {
+	token := p.token
+	switch {
+	case token == "":
+		return nil, p.errorf("unexpected end of formula")
+	case token == "(":
+		p.next()
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, p.errorf("expected ')'")
+		}
+		p.next()
+		return node, nil
+	case token[0] == '[':
+		if !strings.HasSuffix(token, "]") {
+			return nil, p.errorf("missing ']' after channel name")
+		}
+		key, err := p.env.channel(token[1 : len(token)-1])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.next()
+		if !slices.Contains(p.channels, key) {
+			p.channels = append(p.channels, key)
+		}
+		return formulaChannel{key}, nil
+	case strings.EqualFold(token, "x"):
+		p.next()
+		p.raw = true
+		return formulaRaw{}, nil
+	case strings.HasPrefix(token, "0x") || strings.HasPrefix(token, "0X"):
+		value, err := strconv.ParseUint(token[2:], 16, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", token)
+		}
+		p.next()
+		return formulaNumber(value), nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", token)
+		}
+		p.next()
+		return formulaNumber(value), nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		return p.parseCall()
+	}
+	return nil, p.errorf("unexpected %q", token)
+}
+
+func (p *formulaParser) parseCall() (formulaNode, error) {
+	name, start := p.token, p.tokenStart
+	p.next()
+	if p.token != "(" {
+		return nil, p.errorAt(start, "unknown name %q", name)
+	}
+	p.next()
+
+	// lookup takes the name of a table rather than a value
+	if name == "lookup" {
+		tableName := p.token
+		table, ok := p.env.table(tableName)
+		if !ok {
+			return nil, p.errorf("unknown lookup table %q", tableName)
+		}
+		p.next()
+		if p.token != "," {
+			return nil, p.errorf("expected ',' after the table name")
+		}
+		p.next()
+		value, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, p.errorf("lookup takes a table and a value")
+		}
+		p.next()
+		return formulaLookup{table, value}, nil
+	}
+
+	function, ok := formulaFunctions[name]
+	if !ok {
+		return nil, p.errorAt(start, "unknown function %q", name)
+	}
+
+	var args []formulaNode
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.token == ")" {
+			break
+		}
+		if p.token != "," {
+			return nil, p.errorf("expected ',' or ')'")
+		}
+		p.next()
+	}
+	p.next()
+
+	if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+		return nil, p.errorAt(start, "%s takes %s, got %d", name, function.arity(), len(args))
+	}
+
+	return formulaCall{function, args}, nil
+}
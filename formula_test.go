@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// Channels and tables for the formulas to refer to, much as a profile would have them
+func testFormulaEnv(source string) *formulaEnv {
+	return &formulaEnv{
+		source: source,
+		channels: map[string]map[string]bool{
+			"mut":  {"Engine RPM": true, "Throttle Position": true, "Boost": true},
+			"imfd": {"Boost": true, "Exhaust Gas Temperature": true, "Throttle Position": true},
+		},
+		tables: map[string]lookupTable{
+			"thermistor": {{0, 150}, {100, 50}, {200, 0}},
+		},
+	}
+}
+
+func TestFormulaEval(t *testing.T) {
+	tests := []struct {
+		formula string
+		x       float64
+		want    float64
+	}{
+		// Precedence
+		{"1 + 2 * 3", 0, 7},
+		{"(1 + 2) * 3", 0, 9},
+		{"10 - 4 - 3", 0, 3},
+		{"24 / 4 / 2", 0, 3},
+		{"-2 ^ 2", 0, -4},
+		{"2 ^ -1", 0, 0.5},
+		{"2 * 3 ^ 2", 0, 18},
+		{"x * 31.25", 128, 4000},
+		{"(x - 128) / 5", 118, -2},
+		{"X + 1", 1, 2},
+		{"0x10 + 0X0f", 0, 31},
+		{".5 * x", 3, 1.5},
+
+		// Modulo, which binds like * and /
+		{"x % 10", 47, 7},
+		{"1 + x % 10 * 2", 47, 15},
+		{"7.5 % 2", 0, 1.5},
+
+		// Bits and shifts, looser than arithmetic and working on the integer part
+		{"x & 0x0F", 0xAB, 0x0B},
+		{"x | 0x0F", 0xA0, 0xAF},
+		{"x >> 4", 0xAB, 0x0A},
+		{"1 << 4", 0, 16},
+		{"x & 0xF0 >> 4", 0xAB, 0x0B},
+		{"1 + 1 << 2", 0, 8},
+		{"x & 1 | 2", 3, 3},
+		{"x | 1 & 2", 4, 4},
+		{"x & 0xFF", 300.7, 44},
+
+		// Functions
+		{"min(3, x, 5)", 1, 1},
+		{"max(3, x, 5)", 9, 9},
+		{"clamp(x, 0, 100)", 120, 100},
+		{"clamp(x, 0, 100)", -5, 0},
+		{"clamp(x, 0, 100)", 42, 42},
+		{"abs(x)", -3, 3},
+		{"round(x)", 2.5, 3},
+		{"floor(x)", -2.5, -3},
+		{"ceil(x)", 2.1, 3},
+		{"sqrt(x)", 16, 4},
+		{"bit(x, 0)", 5, 1},
+		{"bit(x, 1)", 5, 0},
+		{"bit(x, 2) * 100", 5, 100},
+
+		// Lookups, interpolating between the points and holding the ends
+		{"lookup(thermistor, x)", 0, 150},
+		{"lookup(thermistor, x)", 50, 100},
+		{"lookup(thermistor, x)", 150, 25},
+		{"lookup(thermistor, x)", -20, 150},
+		{"lookup(thermistor, x)", 500, 0},
+		{"lookup(thermistor, x * 2) + 1", 25, 101},
+	}
+	for _, test := range tests {
+		conversion, err := compileFormula(test.formula, testFormulaEnv("mut"))
+		if err != nil {
+			t.Errorf("%s: %v", test.formula, err)
+			continue
+		}
+		if got := conversion(test.x); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s with x = %g: got %g, want %g", test.formula, test.x, got, test.want)
+		}
+	}
+}
+
+func TestFormulaErrors(t *testing.T) {
+	tests := []struct {
+		formula string
+		env     *formulaEnv
+		err     string
+	}{
+		{"", testFormulaEnv("mut"), "unexpected end of formula"},
+		{"x +", testFormulaEnv("mut"), "unexpected end of formula"},
+		{"(x + 1", testFormulaEnv("mut"), "expected ')'"},
+		{"x + 1)", testFormulaEnv("mut"), "column 6"},
+		{"y * 2", testFormulaEnv("mut"), `unknown name "y"`},
+		{"x * pi", testFormulaEnv("mut"), `unknown name "pi"`},
+		{"log(x)", testFormulaEnv("mut"), `unknown function "log"`},
+		{"min(x)", testFormulaEnv("mut"), "min takes at least 2 arguments, got 1"},
+		{"max(x)", testFormulaEnv("mut"), "max takes at least 2 arguments, got 1"},
+		{"clamp(x, 1)", testFormulaEnv("mut"), "clamp takes 3 arguments, got 2"},
+		{"clamp(x, 1, 2, 3)", testFormulaEnv("mut"), "clamp takes 3 arguments, got 4"},
+		{"bit(x)", testFormulaEnv("mut"), "bit takes 2 arguments, got 1"},
+		{"abs(x, 1)", testFormulaEnv("mut"), "abs takes 1 argument, got 2"},
+		{"min(x, )", testFormulaEnv("mut"), "unexpected"},
+		{"lookup(nothing, x)", testFormulaEnv("mut"), `unknown lookup table "nothing"`},
+		{"lookup(thermistor)", testFormulaEnv("mut"), "expected ',' after the table name"},
+		{"lookup(thermistor, x, 1)", testFormulaEnv("mut"), "lookup takes a table and a value"},
+		{"lookup(thermistor, x)", nil, "unknown lookup table"},
+		{"0xZZ", testFormulaEnv("mut"), "bad number"},
+		{"1.2.3", testFormulaEnv("mut"), "bad number"},
+		{"x $ 2", testFormulaEnv("mut"), `unexpected "$"`},
+		{"[Engine RPM", testFormulaEnv("mut"), "missing ']'"},
+		{"[Oil Pressure]", testFormulaEnv("mut"), `unknown channel "Oil Pressure"`},
+		{"[mut:Exhaust Gas Temperature]", testFormulaEnv("mut"), `unknown channel "mut:Exhaust Gas Temperature"`},
+		{"[Engine RPM]", nil, "channel references aren't allowed here"},
+		{"[Boost]", testFormulaEnv(computedSource), `channel "Boost" is ambiguous, qualify it with one of imfd, mut`},
+	}
+	for _, test := range tests {
+		_, err := compileFormula(test.formula, test.env)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error with %q", test.formula, err, test.err)
+		}
+	}
+}
+
+func TestFormulaChannels(t *testing.T) {
+	saved := latestValues
+	latestValues = &channelStore{values: make(map[string]float64)}
+	t.Cleanup(func() { latestValues = saved })
+
+	latestValues.set(channelKey("mut", "Engine RPM"), 3000)
+	latestValues.set(channelKey("mut", "Boost"), 1.2)
+	latestValues.set(channelKey("imfd", "Boost"), 1.5)
+	latestValues.set(channelKey("imfd", "Exhaust Gas Temperature #2"), 800)
+
+	tests := []struct {
+		name     string
+		formula  string
+		source   string
+		want     float64
+		channels []string
+	}{
+		{"own source first", "[Boost]", "mut", 1.2, []string{channelKey("mut", "Boost")}},
+		{"own source first, the other way", "[Boost]", "imfd", 1.5, []string{channelKey("imfd", "Boost")}},
+		{"only one source has it", "[Engine RPM] / 1000", "imfd", 3, []string{channelKey("mut", "Engine RPM")}},
+		{"qualified", "[imfd:Boost] * 100", "mut", 150, []string{channelKey("imfd", "Boost")}},
+		{"qualified with spaces", "[ imfd : Boost ]", "mut", 1.5, []string{channelKey("imfd", "Boost")}},
+		{"an instance of an iMFD sensor", "[Exhaust Gas Temperature #2]", "mut", 800, []string{channelKey("imfd", "Exhaust Gas Temperature #2")}},
+		{"each channel once", "[mut:Boost] + [imfd:Boost] + [mut:Boost]", computedSource, 3.9,
+			[]string{channelKey("mut", "Boost"), channelKey("imfd", "Boost")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formula, channels, err := compileComputedFormula(test.formula, testFormulaEnv(test.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := formula(); math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("got %g, want %g", got, test.want)
+			}
+			if strings.Join(channels, ",") != strings.Join(test.channels, ",") {
+				t.Errorf("refers to %q, want %q", channels, test.channels)
+			}
+		})
+	}
+
+	// Nothing in yet is NaN, rather than zero
+	formula, _, err := compileComputedFormula("[Throttle Position] + 1", testFormulaEnv("mut"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formula(); !math.IsNaN(got) {
+		t.Errorf("before any value: got %g, want NaN", got)
+	}
+}
+
+func TestFormulaPowerChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		formula string
+		deep    bool
+	}{
+		{"short chain", "2^3^2", false},
+		{"short chain with negatives", "2^-1^-2", false},
+		{"long chain", "x" + strings.Repeat("^x", 10000), true},
+		{"long chain with negatives", "x" + strings.Repeat("^-x", 10000), true},
+		{"just over the limit", "x" + strings.Repeat("^x", formulaMaxDepth), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := compileFormula(test.formula, &formulaEnv{})
+			if !test.deep {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+				t.Fatalf("got %v, want it nested too deeply", err)
+			}
+		})
+	}
+
+	// Still right associative
+	conversion, err := compileFormula("2^3^2", &formulaEnv{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conversion(0); got != 512 {
+		t.Errorf("2^3^2: got %v, want 512", got)
+	}
+}
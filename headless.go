@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Record everything the sources read to a session log without touching the terminal,
+// for unattended logging with the lid shut or on a Pi in the boot.
+// Runs until SIGINT or SIGTERM (or the sources run out, replaying a capture),
+// then stops the sources and flushes the log.
+func runLog(args []string) error {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	flags := addSourceFlags(fs, true)
+	outDir := fs.String("out", "logs", "directory to write the session logs to")
+	format := fs.String("format", "csv", "log format: csv (a row every period, as EvoScan writes them) or jsonl (every sample as it arrives)")
+	period := fs.Duration("period", csvLogDefaultPeriod, "time between rows in a csv log")
+	logFile := fs.String("logfile", defaultLogFile, "where to write the debug log")
+	fs.Parse(args)
+
+	createSampleLog, ok := sampleLogFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown log format %q", *format)
+	}
+	config, err := flags.load()
+	if err != nil {
+		return err
+	}
+	if err := useSensorProfile(config.Profile); err != nil {
+		return err
+	}
+	alarms, err := newAlarmMonitor(config.Alarms)
+	if err != nil {
+		return err
+	}
+	closeLog, err := openDebugLog(*logFile)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	sources, err := configuredSources(config)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources configured, nothing to log")
+	}
+	stopCapture, err := flags.startCapture()
+	if err != nil {
+		return err
+	}
+	defer stopCapture()
+
+	session, err := createSampleLog(*outDir, time.Now(), *period)
+	if err != nil {
+		return err
+	}
+
+	// Catch the signals before anything starts, so an early Ctrl-C still gets a clean shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Everything in the profile is wanted, at least at its usual rate
+	sensorDemand.set("logger", demandLogged, loggedChannelKeys())
+	defer sensorDemand.clear("logger")
+	sensorDemand.set("alarms", demandAlarm, alarms.keys())
+	defer sensorDemand.clear("alarms")
+
+	sourceManager := newSourceManager()
+	merged := make(chan struct{})
+	go func() {
+		defer close(merged)
+		sourceManager.merge(sensorDataChannel)
+	}()
+	sourceManager.startAll(sources)
+	sourcesDone := make(chan struct{})
+	go func() {
+		defer close(sourcesDone)
+		sourceManager.wait()
+	}()
+	fmt.Fprintf(os.Stderr, "Logging to %s, Ctrl-C to stop\n", *outDir)
+
+	ticker := time.NewTicker(session.tickInterval())
+	defer ticker.Stop()
+
+	// Stopping the sources can take a moment (the ECU may be part way through a request),
+	// and they need somebody reading what they send until they're done, so the
+	// shutdown runs alongside the loop, which finishes once the last value is in
+	var stopping bool
+	var writeErr error
+	stop := func() {
+		if !stopping {
+			stopping = true
+			go sourceManager.close()
+		}
+	}
+	// Give up on the first error writing the log, there's no point carrying on without it
+	checkWrite := func(err error) {
+		if err != nil && writeErr == nil {
+			writeErr = err
+			log.Printf("Writing the session log failed, stopping: %v", err)
+			stop()
+		}
+	}
+
+	for {
+		select {
+		case value := <-sensorDataChannel:
+			now := time.Now()
+			if writeErr == nil {
+				checkWrite(session.record(now, value))
+			}
+			// Alarms go in the log with the samples that set them off
+			for _, event := range alarms.check(value, now) {
+				fmt.Fprintf(os.Stderr, "%s alarm: %s\n", now.Format("15:04:05"), event)
+				if writeErr == nil {
+					checkWrite(session.note(now, "Alarm: "+event.String()))
+				}
+			}
+		case now := <-ticker.C:
+			if writeErr == nil {
+				checkWrite(session.tick(now))
+			}
+		case status := <-linkStatusChannel:
+			fmt.Fprintf(os.Stderr, "%s %s link: %s (%s)\n", time.Now().Format("15:04:05"), status.source, status.state, status.detail)
+		case <-ecuProfileChannel:
+			// A different profile may have different sensors in it
+			sensorDemand.set("logger", demandLogged, loggedChannelKeys())
+			if writeErr == nil {
+				checkWrite(session.setChannels(loggedChannels()))
+			}
+		case <-sourcesDone:
+			// A replay has run out, there's nothing more to come
+			sourcesDone = nil
+			stop()
+		case sig := <-signals:
+			if !stopping {
+				fmt.Fprintf(os.Stderr, "Got %s, stopping\n", sig)
+			}
+			stop()
+		case <-merged:
+			if writeErr != nil {
+				// Closing would only fail the same way again
+				session.close()
+				return writeErr
+			}
+			if err := session.close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Wrote %s\n", session)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// The recent values of every channel, for the graphs to draw from. Each channel keeps
+// its last historyCapacity values in a ring, so one polled flat out won't go back as
+// far as one that isn't, but even at a hundred a second that's over a minute.
+const historyCapacity = 8192
+
+// A value and when it came in
+type timedSample struct {
+	at    time.Time
+	value float64
+}
+
+// A channel's latest values, oldest first, dropping the oldest once it's full
+type sampleRing struct {
+	samples []timedSample
+
+	// Where the oldest is, once the ring has filled up
+	start int
+}
+
+func (r *sampleRing) add(sample timedSample) {
+	if len(r.samples) < historyCapacity {
+		r.samples = append(r.samples, sample)
+		return
+	}
+	r.samples[r.start] = sample
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+func (r *sampleRing) len() int {
+	return len(r.samples)
+}
+
+// The i-th oldest sample
+func (r *sampleRing) at(i int) timedSample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+func (r *sampleRing) last() (timedSample, bool) {
+	if r.len() == 0 {
+		return timedSample{}, false
+	}
+	return r.at(r.len() - 1), true
+}
+
+// The samples from the given time on, oldest first, led by the one before
+// (if there is one) so we know what the value was at that time
+func (r *sampleRing) since(from time.Time) []timedSample {
+	i := sort.Search(r.len(), func(i int) bool { return !r.at(i).at.Before(from) })
+	if i > 0 {
+		i--
+	}
+	samples := make([]timedSample, 0, r.len()-i)
+	for ; i < r.len(); i++ {
+		samples = append(samples, r.at(i))
+	}
+	return samples
+}
+
+type channelHistory struct {
+	rings map[string]*sampleRing
+
+	// Each channel's stats, and when they were last reset
+	stats      map[string]*channelStats
+	statsSince time.Time
+}
+
+func newChannelHistory() *channelHistory {
+	return &channelHistory{
+		rings:      make(map[string]*sampleRing),
+		stats:      make(map[string]*channelStats),
+		statsSince: time.Now(),
+	}
+}
+
+func (h *channelHistory) record(value SensorValue, at time.Time) {
+	// A bad conversion (dividing by a zero reading, say) isn't worth keeping, it
+	// would only poison the sparklines and stats
+	if math.IsNaN(value.SensorValue) || math.IsInf(value.SensorValue, 0) {
+		return
+	}
+	key := "/" + value.SensorType + "/" + value.SensorLabel
+	ring, ok := h.rings[key]
+	if !ok {
+		ring = &sampleRing{}
+		h.rings[key] = ring
+	}
+	sample := timedSample{at, value.SensorValue}
+	ring.add(sample)
+	h.statsOf(key).add(sample)
+}
+
+// A channel's ring, empty if nothing's come in on it yet
+func (h *channelHistory) ring(key string) *sampleRing {
+	if ring, ok := h.rings[key]; ok {
+		return ring
+	}
+	return &sampleRing{}
+}
+
+// Spread samples over n buckets covering from..to, each holding the highest value
+// that came in during it (so a spike doesn't fall between the cracks) or, if none
+// did, the value it was left at. Also returns the first bucket there was a value
+// for, the ones before that are left at zero.
+func resample(samples []timedSample, from time.Time, to time.Time, n int) ([]float64, int) {
+	values := make([]float64, n)
+	first := n
+	span := to.Sub(from)
+
+	held, haveHeld := 0.0, false
+	j := 0
+	for i := 0; i < n; i++ {
+		start := from.Add(span * time.Duration(i) / time.Duration(n))
+		end := from.Add(span * time.Duration(i+1) / time.Duration(n))
+
+		highest, any := 0.0, false
+		for ; j < len(samples) && samples[j].at.Before(end); j++ {
+			sample := samples[j]
+			if !sample.at.Before(start) && (!any || sample.value > highest) {
+				highest, any = sample.value, true
+			}
+			held, haveHeld = sample.value, true
+		}
+
+		switch {
+		case any:
+			values[i] = highest
+		case haveHeld:
+			values[i] = held
+		default:
+			continue
+		}
+		first = min(first, i)
+	}
+	return values, first
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errImfdBadPacket     = errors.New("imfd: malformed packet")
+	errImfdUnknownSensor = errors.New("imfd: unknown sensor type")
+)
+
+// A single reading off the iMFD bus, before any conversion
+type imfdPacket struct {
+	sensorType int
+
+	// Which of several sensors of the same type this is (EGT on each bank, say), from 0
+	instance int
+
+	raw int
+}
+
+// Unpack a five byte packet, checking it could really have come off the bus
+func decodeImfdPacket(packet []byte) (imfdPacket, error) {
+	if len(packet) != imfdPacketSize {
+		return imfdPacket{}, fmt.Errorf("%w: %d bytes, expected %d", errImfdBadPacket, len(packet), imfdPacketSize)
+	}
+
+	// Only the low six bits of each byte carry data, anything else
+	// means we've lost our place in the frame or the line is noisy
+	for i, b := range packet {
+		if b&^0x3F != 0 {
+			return imfdPacket{}, fmt.Errorf("%w: byte %d is 0x%02X", errImfdBadPacket, i, b)
+		}
+	}
+
+	decoded := imfdPacket{
+		sensorType: int(packet[0])<<6 | int(packet[1]),
+		instance:   int(packet[2]),
+		raw:        int(packet[3])<<6 | int(packet[4]),
+	}
+	if decoded.raw > imfdMaxRawValue {
+		return imfdPacket{}, fmt.Errorf("%w: value 0x%03X is more than ten bits", errImfdBadPacket, decoded.raw)
+	}
+	return decoded, nil
+}
+
+// The channel name for an instance of a sensor. The first keeps the plain name,
+// so a car with a single EGT doesn't have to care, the rest are numbered from #2.
+func imfdChannelName(name string, instance int) string {
+	if instance == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s #%d", name, instance+1)
+}
+
+// Split "Exhaust Gas Temperature #2" back into the sensor name and instance (1)
+func splitImfdChannelName(channel string) (string, int, error) {
+	i := strings.LastIndex(channel, "#")
+	if i < 0 {
+		return channel, 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(channel[i+1:]))
+	if err != nil || n < 1 || n > 0x3F+1 {
+		return channel, 0, fmt.Errorf("bad instance in %q", channel)
+	}
+	return strings.TrimSpace(channel[:i]), n - 1, nil
+}
+
+// Decode the sensor response from the IMFD into a struct, and perform any necessary conversions
+func imfdSensorDecode(packet imfdPacket) (SensorValue, error) {
+	sensorTablesMu.RLock()
+	sensor, ok := imfdSensors[packet.sensorType]
+	sensorTablesMu.RUnlock()
+	if !ok {
+		return SensorValue{}, fmt.Errorf("%w %d", errImfdUnknownSensor, packet.sensorType)
+	}
+
+	return SensorValue{
+		SensorLabel:    imfdChannelName(sensor.name, packet.instance),
+		SensorType:     sourceSensorType("imfd"),
+		SensorInstance: packet.instance,
+		SensorValue:    sensor.conversionFunction(float64(packet.raw)),
+		SensorUnit:     sensor.unit,
+	}, nil
+}
+
+var (
+	errImfdRuntFrame = errors.New("imfd: runt frame")
+	errImfdBadFrame  = errors.New("imfd: malformed frame")
+	errImfdSilent    = errors.New("imfd: no data")
+)
+
+// The controller sends a frame every 100ms or so, this long without
+// one means something is wrong with it or the cable
+const imfdSilenceTimeout = 2 * time.Second
+
+// The serial port returns nothing at all (rather than an error) when a read times out,
+// which would have bufio give up on it, so turn that into an error we can recognise
+type imfdSilenceReader struct {
+	r io.Reader
+}
+
+func (r imfdSilenceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n == 0 && err == nil {
+		return 0, errImfdSilent
+	}
+	return n, err
+}
+
+// The longest frame we'll believe, a controller only has a handful of gauges
+// hanging off it so anything longer has lost its terminator
+const imfdMaxFrameSize = 3 + 64*imfdPacketSize
+
+// Check a frame (including its '@') and unpack the packets in it
+func parseImfdFrame(frame []byte) ([]imfdPacket, error) {
+	if len(frame) < 3 || frame[len(frame)-1] != imfdFrameEnd {
+		return nil, fmt.Errorf("%w: only %d bytes", errImfdRuntFrame, len(frame))
+	}
+	if frame[0] != imfdFrameStart {
+		return nil, fmt.Errorf("%w: starts with 0x%02X", errImfdBadFrame, frame[0])
+	}
+
+	// Without its stop byte the frame was cut off, unless what's there instead is line noise
+	last := frame[len(frame)-2]
+	if last != imfdFrameStop {
+		if last&^0x3F != 0 {
+			return nil, fmt.Errorf("%w: stop byte is 0x%02X", errImfdBadFrame, last)
+		}
+		return nil, fmt.Errorf("%w: cut off before the stop byte", errImfdRuntFrame)
+	}
+
+	// One cut off part way through its first packet can stop on a data byte that looks like a stop byte
+	payload := frame[1 : len(frame)-2]
+	if len(payload) < imfdPacketSize && len(payload) > 0 {
+		return nil, fmt.Errorf("%w: cut off %d bytes into a packet", errImfdRuntFrame, len(payload))
+	}
+
+	// With its stop byte, a frame that isn't whole packets is two run together (one lost
+	// its terminator) or has had bytes dropped or added, either way it's damaged rather than short
+	if len(payload)%imfdPacketSize != 0 {
+		return nil, fmt.Errorf("%w: ends %d bytes into a packet", errImfdBadFrame, len(payload)%imfdPacketSize)
+	}
+
+	// Each gauge only reports once a frame, seeing one twice means
+	// two damaged frames have run together and happen to line up
+	seen := make(map[[2]int]bool, len(payload)/imfdPacketSize)
+	packets := make([]imfdPacket, 0, len(payload)/imfdPacketSize)
+	for i := 0; i < len(payload); i += imfdPacketSize {
+		packet, err := decodeImfdPacket(payload[i : i+imfdPacketSize])
+		if err != nil {
+			return nil, fmt.Errorf("%w: packet %d: %v", errImfdBadFrame, i/imfdPacketSize, err)
+		}
+		channel := [2]int{packet.sensorType, packet.instance}
+		if seen[channel] {
+			return nil, fmt.Errorf("%w: sensor %d instance %d appears twice", errImfdBadFrame, packet.sensorType, packet.instance)
+		}
+		seen[channel] = true
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+// How the iMFD stream is holding up
+type imfdFrameStats struct {
+	good uint64
+	bad  uint64
+	runt uint64
+
+	// Partial frames thrown away while finding our place in the stream
+	resync uint64
+}
+
+func (s imfdFrameStats) String() string {
+	return fmt.Sprintf("ok %d bad %d runt %d", s.good, s.bad, s.runt)
+}
+
+// Pulls frames off the iMFD stream, throwing away anything damaged.
+// Every frame ends in '@', which can't appear anywhere else, so after a bad
+// frame the next one starts straight after the '@' and we're back in step.
+type imfdFrameParser struct {
+	reader *bufio.Reader
+	stats  imfdFrameStats
+
+	// Where the raw frames are recorded, if anywhere
+	capture *captureWriter
+
+	// Whether we've seen a terminator yet, before then we've most
+	// likely started listening part way through a frame
+	synced bool
+}
+
+func newImfdFrameParser(r io.Reader, capture *captureWriter) *imfdFrameParser {
+	return &imfdFrameParser{reader: bufio.NewReaderSize(r, imfdMaxFrameSize), capture: capture}
+}
+
+// The packets in the next good frame. Only fails if the stream itself does.
+func (p *imfdFrameParser) next() ([]imfdPacket, error) {
+	for {
+		frame, err := p.readFrame()
+		if err == bufio.ErrBufferFull {
+			// No terminator in sight, skip ahead to the next one
+			if err = p.skipFrame(); err != nil {
+				return nil, err
+			}
+			p.stats.bad++
+			p.synced = true
+			log.Printf("[IMFD] Dropping frame longer than %d bytes", imfdMaxFrameSize)
+			continue
+		}
+		if err != nil {
+			// Whatever was read of this frame is gone, so the next one may not be whole
+			p.synced = false
+			return nil, err
+		}
+
+		packets, err := parseImfdFrame(frame)
+		switch {
+		case err == nil:
+			p.stats.good++
+			p.synced = true
+			return packets, nil
+		case !p.synced:
+			p.stats.resync++
+		case errors.Is(err, errImfdRuntFrame):
+			p.stats.runt++
+		default:
+			p.stats.bad++
+		}
+		p.synced = true
+		log.Printf("[IMFD] Dropping frame % X: %v", frame, err)
+	}
+}
+
+// Throw away everything up to and including the next terminator
+func (p *imfdFrameParser) skipFrame() error {
+	for {
+		_, err := p.readFrame()
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// Read up to and including the next terminator, recording the raw bytes if we're capturing.
+// A failed read is recorded along with why (and whatever of the frame it lost),
+// replaying it has to go wrong the same way.
+func (p *imfdFrameParser) readFrame() ([]byte, error) {
+	frame, err := p.reader.ReadSlice(imfdFrameEnd)
+	failed := err != nil && err != bufio.ErrBufferFull
+	if p.capture != nil && (len(frame) > 0 || failed) {
+		note := ""
+		if failed {
+			note = "error: " + err.Error()
+		}
+		p.capture.record("imfd", captureFrame, frame, note)
+	}
+	return frame, err
+}
+
+// How often the frame counters are logged and sent to the dashboard
+const imfdStatsInterval = 5 * time.Second
+
+var imfdStatsChannel = make(chan imfdFrameStats, 4)
+
+// Log the frame counters and pass them on to the dashboard, without blocking the stream on it
+func reportImfdStats(stats imfdFrameStats) {
+	log.Printf("[IMFD] Frames: %s, resync %d", stats, stats.resync)
+	select {
+	case imfdStatsChannel <- stats:
+	default:
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A frame off the bus: wideband raw 0x100, then EGT on both banks (732 and 752)
+var capturedImfdFrame = []byte{
+	0x01,
+	0x00, 0x00, 0x00, 0x04, 0x00,
+	0x00, 0x01, 0x00, 0x0B, 0x1C,
+	0x00, 0x01, 0x01, 0x0B, 0x30,
+	0x04, '@',
+}
+
+// A copy of a frame with some bytes changed, so the tests can't damage the original
+func patchFrame(frame []byte, patches map[int]byte) []byte {
+	patched := append([]byte(nil), frame...)
+	for i, b := range patches {
+		if i < 0 {
+			i += len(patched)
+		}
+		patched[i] = b
+	}
+	return patched
+}
+
+// Frames cut short are runts, frames that are the wrong shape are bad
+func TestParseImfdFrameDamageClass(t *testing.T) {
+	withoutTerminator := capturedImfdFrame[:len(capturedImfdFrame)-1]
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"cut after the start byte", []byte{0x01, '@'}, errImfdRuntFrame},
+		{"cut in the first packet", []byte{0x01, 0x00, 0x00, '@'}, errImfdRuntFrame},
+		{"cut in a later packet", append(append([]byte(nil), capturedImfdFrame[:9]...), '@'), errImfdRuntFrame},
+		{"terminator lost, running into the next", append(append([]byte(nil), withoutTerminator...), capturedImfdFrame...), errImfdBadFrame},
+		{"extra byte", append([]byte{0x01, 0x00}, capturedImfdFrame[1:]...), errImfdBadFrame},
+		{"stop byte damaged", patchFrame(capturedImfdFrame, map[int]byte{-2: 0x84}), errImfdBadFrame},
+		{"cut on a byte that looks like a stop byte", []byte{0x01, 0x00, 0x00, 0x00, 0x04, '@'}, errImfdRuntFrame},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseImfdFrame(test.frame)
+			if !errors.Is(err, test.err) {
+				t.Errorf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// The counters go up for the right kind of damage as frames come off the stream
+func TestImfdFrameParserStats(t *testing.T) {
+	var stream []byte
+	stream = append(stream, capturedImfdFrame...)
+	stream = append(stream, 0x01, 0x00, 0x00, '@')                                   // runt
+	stream = append(stream, capturedImfdFrame[:len(capturedImfdFrame)-1]...)         // lost its terminator,
+	stream = append(stream, capturedImfdFrame...)                                    // so runs into this one
+	stream = append(stream, patchFrame(capturedImfdFrame, map[int]byte{3: 0x80})...) // bad byte
+	stream = append(stream, capturedImfdFrame...)
+
+	parser := newImfdFrameParser(bytes.NewReader(stream), nil)
+	for {
+		if _, err := parser.next(); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	want := imfdFrameStats{good: 2, bad: 2, runt: 1}
+	if parser.stats != want {
+		t.Errorf("got %s (resync %d), want %s", parser.stats, parser.stats.resync, want)
+	}
+}
+
+// What the simulator's corruption modes do is counted as what they're meant to be
+func TestImfdSimulatorCorruptionClass(t *testing.T) {
+	tests := []struct {
+		mode string
+		err  error
+	}{
+		{"runt", errImfdRuntFrame},
+		{"badbyte", errImfdBadFrame},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			sim := &imfdSimulator{corruption: map[string]float64{test.mode: 1}, rand: rand.New(rand.NewSource(1))}
+			for i := 0; i < 50; i++ {
+				frame := sim.corrupt(append([]byte(nil), capturedImfdFrame...))
+				if _, err := parseImfdFrame(frame); !errors.Is(err, test.err) {
+					t.Fatalf("frame % X: got %v, want %v", frame, err, test.err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeImfdPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   imfdPacket
+		err    bool
+	}{
+		{"wideband", []byte{0x00, 0x00, 0x00, 0x04, 0x00}, imfdPacket{sensorType: 0, instance: 0, raw: 0x100}, false},
+		{"second EGT", []byte{0x00, 0x01, 0x01, 0x0B, 0x30}, imfdPacket{sensorType: 1, instance: 1, raw: 752}, false},
+		{"high sensor type", []byte{0x01, 0x02, 0x00, 0x00, 0x3F}, imfdPacket{sensorType: 66, instance: 0, raw: 0x3F}, false},
+		{"top value", []byte{0x00, 0x04, 0x00, 0x0F, 0x3F}, imfdPacket{sensorType: 4, instance: 0, raw: 0x3FF}, false},
+		{"short", []byte{0x00, 0x00, 0x00, 0x04}, imfdPacket{}, true},
+		{"long", []byte{0x00, 0x00, 0x00, 0x04, 0x00, 0x00}, imfdPacket{}, true},
+		{"top bits set", []byte{0x00, 0x40, 0x00, 0x04, 0x00}, imfdPacket{}, true},
+		{"value over ten bits", []byte{0x00, 0x00, 0x00, 0x10, 0x00}, imfdPacket{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet, err := decodeImfdPacket(test.packet)
+			if test.err {
+				if !errors.Is(err, errImfdBadPacket) {
+					t.Fatalf("got %+v and error %v, want a bad packet", packet, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet != test.want {
+				t.Errorf("got %+v, want %+v", packet, test.want)
+			}
+		})
+	}
+}
+
+func TestParseImfdFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		packets []imfdPacket
+		err     error
+	}{
+		{"several instances of one sensor", capturedImfdFrame, []imfdPacket{
+			{sensorType: 0, instance: 0, raw: 0x100},
+			{sensorType: 1, instance: 0, raw: 732},
+			{sensorType: 1, instance: 1, raw: 752},
+		}, nil},
+		{"no gauges", []byte{0x01, 0x04, '@'}, []imfdPacket{}, nil},
+		{"runt", []byte{0x01, '@'}, nil, errImfdRuntFrame},
+		{"no terminator", capturedImfdFrame[:len(capturedImfdFrame)-1], nil, errImfdRuntFrame},
+		{"bad start byte", patchFrame(capturedImfdFrame, map[int]byte{0: 0x02}), nil, errImfdBadFrame},
+		{"bad byte", patchFrame(capturedImfdFrame, map[int]byte{7: 0x81}), nil, errImfdBadFrame},
+		{"value over ten bits", patchFrame(capturedImfdFrame, map[int]byte{4: 0x3F}), nil, errImfdBadFrame},
+		{"same instance twice", patchFrame(capturedImfdFrame, map[int]byte{13: 0x00}), nil, errImfdBadFrame},
+		{"stop byte damaged", patchFrame(capturedImfdFrame, map[int]byte{-2: 0xC4}), nil, errImfdBadFrame},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets, err := parseImfdFrame(test.frame)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got %+v and error %v, want %v", packets, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packets) != len(test.packets) {
+				t.Fatalf("got %+v, want %+v", packets, test.packets)
+			}
+			for i := range packets {
+				if packets[i] != test.packets[i] {
+					t.Errorf("packet %d: got %+v, want %+v", i, packets[i], test.packets[i])
+				}
+			}
+		})
+	}
+}
+
+// Swap in the iMFD sensors from the built-in profile for the length of a test
+func useBuiltInImfdSensors(t *testing.T) {
+	t.Helper()
+	profile, err := readSensorProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := profile.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensorTablesMu.Lock()
+	saved := imfdSensors
+	imfdSensors = tables.imfd
+	sensorTablesMu.Unlock()
+	t.Cleanup(func() {
+		sensorTablesMu.Lock()
+		imfdSensors = saved
+		sensorTablesMu.Unlock()
+	})
+}
+
+func TestImfdSensorDecode(t *testing.T) {
+	useBuiltInImfdSensors(t)
+	packets, err := parseImfdFrame(capturedImfdFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SensorValue{
+		{"Wide-Band Air/Fuel", "imfd-sensor", 0, (0x100/3.75 + 68) / 100, "Lambda"},
+		{"Exhaust Gas Temperature", "imfd-sensor", 0, 732, "°C"},
+		{"Exhaust Gas Temperature #2", "imfd-sensor", 1, 752, "°C"},
+	}
+	for i, packet := range packets {
+		value, err := imfdSensorDecode(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		near := math.Abs(value.SensorValue-want[i].SensorValue) < 1e-9
+		value.SensorValue = want[i].SensorValue
+		if !near || value != want[i] {
+			t.Errorf("packet %d: got %+v, want %+v", i, value, want[i])
+		}
+	}
+
+	if _, err := imfdSensorDecode(imfdPacket{sensorType: 63, raw: 1}); !errors.Is(err, errImfdUnknownSensor) {
+		t.Errorf("unknown sensor: got %v, want %v", err, errImfdUnknownSensor)
+	}
+}
+
+func TestImfdChannelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance int
+		channel  string
+	}{
+		{"Boost", 0, "Boost"},
+		{"Exhaust Gas Temperature", 1, "Exhaust Gas Temperature #2"},
+		{"Exhaust Gas Temperature", 63, "Exhaust Gas Temperature #64"},
+	}
+	for _, test := range tests {
+		channel := imfdChannelName(test.name, test.instance)
+		if channel != test.channel {
+			t.Errorf("%s instance %d: got %q, want %q", test.name, test.instance, channel, test.channel)
+		}
+		name, instance, err := splitImfdChannelName(channel)
+		if err != nil || name != test.name || instance != test.instance {
+			t.Errorf("splitting %q: got %q, %d, %v", channel, name, instance, err)
+		}
+	}
+
+	for _, bad := range []string{"Boost #0", "Boost #x", "Boost #66"} {
+		if _, _, err := splitImfdChannelName(bad); err == nil {
+			t.Errorf("splitting %q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iMFD frames look like this on the wire:
+//
+//	start | packet | packet | ... | stop | '@'
+//
+// where each packet is five bytes: sensor type (high, low), instance, value (high, low).
+// Every data byte only carries six bits, so the '@' (0x40) terminator can't turn up inside a frame.
+const (
+	imfdFrameStart  byte = 0x01
+	imfdFrameStop   byte = 0x04
+	imfdFrameEnd    byte = '@'
+	imfdPacketSize       = 5
+	imfdMaxRawValue      = 0x3FF
+)
+
+// How often the simulated controller sends a frame
+const imfdSimInterval = 100 * time.Millisecond
+
+// The waveforms the iMFD simulator runs when it isn't given a script.
+// Every sensor type gets at least one instance, the "#2" lines add a second.
+const defaultImfdSimScript = `
+Wide-Band Air/Fuel:          spool 1.0 0.78 8s
+Exhaust Gas Temperature:     sine 600 850 12s
+Exhaust Gas Temperature #2:  sine 620 870 12s
+Fluid Temperature:           constant 95
+Fluid Temperature #2:        constant 105
+Vacuum:                      constant 780
+Boost:                       spool 0 0.2 8s
+Air Intake Temperature:      constant 30
+RPM:                         sweep 800 7000 8s
+Vehicle Speed:               sweep 20 140 8s
+Throttle Position:           spool 5 100 8s
+Engine Load:                 spool 20 100 8s
+Fuel Pressure:               constant 3
+Timing:                      sweep 25 12 8s
+MAP:                         spool 100 250 8s
+MAF:                         sweep 5 250 8s
+Short Term Fuel Trim:        sine -5 5 3s
+Long Term Fuel Trim:         constant 2
+Narrow-Band Oxygen Sensor:   sine 10 90 2s
+Fuel Level:                  constant 60
+Volt Meter:                  sine 13.8 14.4 5s
+Knock:                       burst 0.5 3.5 8s 400ms
+Duty Cycle:                  spool 10 85 8s
+`
+
+// The ways the simulator can deliberately mangle a frame
+var imfdCorruptionModes = []string{"runt", "badbyte", "noterm"}
+
+// One simulated gauge on the bus
+type imfdSimChannel struct {
+	sensorType int
+	instance   int
+	waveform   simWaveform
+
+	// The sensor's conversion run backwards, worked out once when the script's loaded
+	inverse rawInverse
+}
+
+// A simulated Defi/iMFD controller
+type imfdSimulator struct {
+	channels []imfdSimChannel
+
+	// Probability (0..1) of each corruption mode hitting any given frame
+	corruption map[string]float64
+
+	started time.Time
+	rand    *rand.Rand
+}
+
+// Parse an iMFD simulator script. Lines bind a sensor (by its name in tables,
+// with an optional "#n" instance suffix) to a waveform, or set a corruption rate:
+//
+//	Exhaust Gas Temperature #2: sine 620 870 12s
+//	Boost:                      spool 0 0.2 8s
+//	corrupt:                    runt 0.05
+//
+// Blank lines and lines starting with # are ignored.
+func parseImfdSimScript(r io.Reader, tables *sensorTables) (*imfdSimulator, error) {
+	// Build a reverse lookup so sensors can be referred to by name
+	sensorTypes := make(map[string]int, len(tables.imfd))
+	for sensorType, sensor := range tables.imfd {
+		sensorTypes[strings.ToLower(sensor.name)] = sensorType
+	}
+
+	sim := &imfdSimulator{
+		corruption: make(map[string]float64),
+		started:    time.Now(),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected 'sensor: waveform'", lineNumber)
+		}
+		name := strings.TrimSpace(line[:i])
+		fields := strings.Fields(line[i+1:])
+
+		if name == "corrupt" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expected 'corrupt: mode probability'", lineNumber)
+			}
+			if !isImfdCorruptionMode(fields[0]) {
+				return nil, fmt.Errorf("line %d: unknown corruption mode %q, expected one of %s",
+					lineNumber, fields[0], strings.Join(imfdCorruptionModes, ", "))
+			}
+			probability, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			sim.corruption[fields[0]] = probability
+			continue
+		}
+
+		// Peel off the instance number, "#1" is the first (instance 0)
+		name, instance, err := splitImfdChannelName(name)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		sensorType, ok := sensorTypes[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown sensor %q", lineNumber, name)
+		}
+
+		waveform, err := parseSimWaveform(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		inverse := newRawInverse(tables.imfd[sensorType].conversionFunction, imfdMaxRawValue)
+		sim.channels = append(sim.channels, imfdSimChannel{sensorType, instance, waveform, inverse})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keep the frame layout stable regardless of the order of the script
+	sort.Slice(sim.channels, func(i, j int) bool {
+		if sim.channels[i].sensorType != sim.channels[j].sensorType {
+			return sim.channels[i].sensorType < sim.channels[j].sensorType
+		}
+		return sim.channels[i].instance < sim.channels[j].instance
+	})
+
+	return sim, nil
+}
+
+func isImfdCorruptionMode(mode string) bool {
+	for _, m := range imfdCorruptionModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the simulator script from a file, or the default script if the path is empty
+func loadImfdSimulator(scriptPath string) (*imfdSimulator, error) {
+	var script io.Reader = strings.NewReader(defaultImfdSimScript)
+	if scriptPath != "" {
+		f, err := os.Open(scriptPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		script = f
+	}
+
+	// The simulated gauges are the ones the built-in profile describes
+	profile, err := readSensorProfile("")
+	if err != nil {
+		return nil, err
+	}
+	tables, err := profile.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	sim, err := parseImfdSimScript(script, tables)
+	if err != nil {
+		return nil, fmt.Errorf("iMFD simulator script: %w", err)
+	}
+	return sim, nil
+}
+
+// Pack a single sensor reading into its five byte packet
+func encodeImfdPacket(sensorType int, instance int, raw int) [imfdPacketSize]byte {
+	return [imfdPacketSize]byte{
+		byte(sensorType>>6) & 0x3F,
+		byte(sensorType) & 0x3F,
+		byte(instance) & 0x3F,
+		byte(raw>>6) & 0x3F,
+		byte(raw) & 0x3F,
+	}
+}
+
+// Build a correctly packed frame holding every channel's value at time t
+func (s *imfdSimulator) frame(at time.Duration) []byte {
+	frame := make([]byte, 0, 3+len(s.channels)*imfdPacketSize)
+	frame = append(frame, imfdFrameStart)
+
+	for _, channel := range s.channels {
+		raw := channel.inverse.rawFor(channel.waveform.valueAt(at))
+		packet := encodeImfdPacket(channel.sensorType, channel.instance, raw)
+		frame = append(frame, packet[:]...)
+	}
+
+	return append(frame, imfdFrameStop, imfdFrameEnd)
+}
+
+// Maybe damage a frame, depending on the configured corruption rates
+func (s *imfdSimulator) corrupt(frame []byte) []byte {
+	// Nothing worth damaging in an empty frame
+	if len(frame) <= 3 {
+		return frame
+	}
+
+	if s.rand.Float64() < s.corruption["badbyte"] {
+		// Set the top bits on a data byte, which can never happen on a healthy bus
+		i := 1 + s.rand.Intn(len(frame)-3)
+		frame[i] |= 0x80
+	}
+	if s.rand.Float64() < s.corruption["runt"] {
+		// Chop the frame off part way through a packet, keeping the terminator
+		cut := 1 + s.rand.Intn(imfdPacketSize)
+		frame = append(frame[:cut:cut], imfdFrameEnd)
+	}
+	if s.rand.Float64() < s.corruption["noterm"] {
+		// Drop the terminator, so this frame runs into the next one
+		frame = frame[:len(frame)-1]
+	}
+	return frame
+}
+
+// Write frames to w until it fails
+func (s *imfdSimulator) run(w io.Writer) error {
+	ticker := time.NewTicker(imfdSimInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		frame := s.corrupt(s.frame(time.Since(s.started)))
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start the simulator on a pty, returning the path of the port to read the frames from
+func startImfdSimulatorPty(scriptPath string) (string, error) {
+	sim, err := loadImfdSimulator(scriptPath)
+	if err != nil {
+		return "", err
+	}
+
+	master, slavePath, err := openPty()
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		err := sim.run(master)
+		log.Printf("iMFD simulator on %s stopped: %v", slavePath, err)
+	}()
+	log.Printf("iMFD simulator sending on %s", slavePath)
+
+	return slavePath, nil
+}
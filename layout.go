@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+)
+
+// Dashboard layouts: which widgets go where and what they show, read from a JSON
+// file so everyone can have the dashboard they like without touching the Go.
+// A layout has up to nine pages, switched between with the number keys or Tab.
+//
+//	{
+//	  "pages": [
+//	    {"name": "street", "rows": [
+//	      {"height": 1, "widgets": [
+//	        {"type": "text", "title": "Coolant", "channel": "mut:Coolant Temp", "colour": "yellow"},
+//	        {"type": "link", "title": "MUT Link", "source": "mut"}
+//	      ]},
+//	      {"height": 2, "widgets": [
+//	        {"type": "gauge", "channel": "Boost", "min": -1, "max": 2, "format": "%.2f", "width": 2},
+//	        {"type": "gauge", "channel": "Engine RPM", "colour": "green"}
+//	      ]},
+//	      {"height": 2, "widgets": [
+//	        {"type": "plot", "channels": ["Engine RPM", "Boost", "Wide-Band Air/Fuel"], "window": 30},
+//	        {"type": "sparkline", "channels": ["Knock Sum"], "window": 60, "colours": ["yellow"]}
+//	      ]}
+//	    ]},
+//	    {"name": "track", "rows": [...]}
+//	  ]
+//	}
+//
+// A layout with just the one page can give its "rows" without a page around them.
+// Rows share out the height of the screen, and widgets the width of their row, in
+// proportion to their height and width (1 when left out). Channels are named the way
+// formulas name them, "source:name", or just the name when only one source has it.
+// Gauges go from the channel's min to its max in the profile unless given their own,
+// values are shown with the profile's decimals unless given a format (for the number,
+// the unit follows it) and colours are termui's: black, red, green, yellow, blue,
+// magenta, cyan and white.
+//
+// Plots and sparklines draw each of their channels over the last "window" seconds (30
+// when left out), in the "colours" given or a colour each of their own. Channels with
+// different units wouldn't share an axis, so each is drawn from the bottom of its
+// range to the top, and min and max (when given) apply to all of them.
+//
+// Stat widgets show one statistic of their channel since the stats were last reset
+// (with the r key): its lowest ("min") or highest ("max") value, the "mean" of all
+// of them, the "average" of the last "samples" (10 when left out), or how long it's
+// been "above" a "threshold". Stats tables show all of those for each of their
+// channels, with the time above the channel's entry in "thresholds" (null for none).
+//
+//	{"type": "stat", "title": "Peak Boost", "channel": "Boost", "stat": "max", "format": "%.2f"},
+//	{"type": "stat", "channel": "Knock Sum", "stat": "above", "threshold": 3},
+//	{"type": "stats", "channels": ["Boost", "Knock Sum", "Engine RPM"], "thresholds": [1.0, 3], "samples": 20}
+//
+// While the dashboard is up the file is watched, so saving it puts the new layout on screen.
+
+// The layout we ship with, used when none is given
+//
+//go:embed layouts/default.json
+var defaultLayoutJSON []byte
+
+type dashboardLayout struct {
+	Pages []layoutPage `json:"pages"`
+
+	// The rows of a layout with only the one page
+	Rows []layoutRow `json:"rows"`
+}
+
+// The most pages a layout can have, one for each number key
+const layoutMaxPages = 9
+
+type layoutPage struct {
+	Name string      `json:"name"`
+	Rows []layoutRow `json:"rows"`
+}
+
+type layoutRow struct {
+	Height  float64        `json:"height"`
+	Widgets []layoutWidget `json:"widgets"`
+}
+
+type layoutWidget struct {
+	Type  string  `json:"type"`
+	Title string  `json:"title"`
+	Width float64 `json:"width"`
+
+	// The channel it shows (or for graphs, channels), or for a link widget the source whose link it shows
+	Channel  string   `json:"channel"`
+	Channels []string `json:"channels"`
+	Source   string   `json:"source"`
+
+	// How many seconds back a graph goes
+	Window float64 `json:"window"`
+
+	// Which statistic a stat widget shows, how many values an average is over, and the
+	// thresholds to count the time above (one for each channel of a stats table)
+	Stat       string     `json:"stat"`
+	Samples    int        `json:"samples"`
+	Threshold  *float64   `json:"threshold"`
+	Thresholds []*float64 `json:"thresholds"`
+
+	Min    *float64 `json:"min"`
+	Max    *float64 `json:"max"`
+	Format string   `json:"format"`
+	Unit   *string  `json:"unit"`
+
+	Colour       string `json:"colour"`
+	LabelColour  string `json:"labelColour"`
+	TitleColour  string `json:"titleColour"`
+	BorderColour string `json:"borderColour"`
+
+	// A colour for each channel of a graph
+	Colours []string `json:"colours"`
+
+	// The keys of the channels, once the layout's been checked
+	keys []string
+}
+
+// How far back graphs go unless the layout says otherwise
+const layoutDefaultWindow = 30 * time.Second
+
+// The channels as given, the single one first
+func (w *layoutWidget) channels() []string {
+	if w.Channel == "" {
+		return w.Channels
+	}
+	return append([]string{w.Channel}, w.Channels...)
+}
+
+// The key of the widget's (first) channel
+func (w *layoutWidget) key() string {
+	if len(w.keys) == 0 {
+		return ""
+	}
+	return w.keys[0]
+}
+
+// The threshold for each of the widget's channels, nil where there isn't one
+func (w *layoutWidget) thresholds() []*float64 {
+	thresholds := w.Thresholds
+	if w.Channel != "" {
+		thresholds = append([]*float64{w.Threshold}, thresholds...)
+	}
+	for len(thresholds) < len(w.keys) {
+		thresholds = append(thresholds, nil)
+	}
+	return thresholds[:len(w.keys)]
+}
+
+// How many values an average is over
+func (w *layoutWidget) samples() int {
+	if w.Samples == 0 {
+		return statsDefaultSamples
+	}
+	return w.Samples
+}
+
+// How far back a graph goes
+func (w *layoutWidget) window() time.Duration {
+	if w.Window == 0 {
+		return layoutDefaultWindow
+	}
+	return time.Duration(w.Window * float64(time.Second))
+}
+
+// The sources that have a link for a link widget to show
+var layoutLinkSources = map[string]bool{"mut": true, "imfd": true}
+
+var layoutColours = map[string]ui.Color{
+	"black":   ui.ColorBlack,
+	"red":     ui.ColorRed,
+	"green":   ui.ColorGreen,
+	"yellow":  ui.ColorYellow,
+	"blue":    ui.ColorBlue,
+	"magenta": ui.ColorMagenta,
+	"cyan":    ui.ColorCyan,
+	"white":   ui.ColorWhite,
+}
+
+// Set a colour from the layout, if it gives one
+func applyLayoutColour(colour *ui.Color, name string) {
+	if c, ok := layoutColours[strings.ToLower(name)]; ok {
+		*colour = c
+	}
+}
+
+// Read a layout file, or the built-in layout if the path is empty
+func readDashboardLayout(path string) (*dashboardLayout, error) {
+	data := defaultLayoutJSON
+	name := "built-in layout"
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		name = "layout " + path
+	}
+
+	// Layouts are written by hand, so a misspelt field is an error rather than quietly ignored
+	var layout dashboardLayout
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&layout); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	env := knownChannels()
+	if path == "" {
+		// Our layout has to make do with whatever profile it's given
+		layout.dropUnknownChannels(env)
+	}
+	if err := layout.check(env); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &layout, nil
+}
+
+// Make sure everything in the layout makes sense, filling in the defaults and resolving the channels
+func (layout *dashboardLayout) check(env *formulaEnv) error {
+	if len(layout.Rows) > 0 {
+		if len(layout.Pages) > 0 {
+			return errors.New("give either pages or rows, not both")
+		}
+		layout.Pages = []layoutPage{{Rows: layout.Rows}}
+		layout.Rows = nil
+	}
+	if len(layout.Pages) == 0 {
+		return errors.New("no pages")
+	}
+	if len(layout.Pages) > layoutMaxPages {
+		return fmt.Errorf("%d pages, there are only keys for %d", len(layout.Pages), layoutMaxPages)
+	}
+	for i := range layout.Pages {
+		page := &layout.Pages[i]
+		if page.Name == "" {
+			page.Name = fmt.Sprintf("page %d", i+1)
+		}
+		if err := page.check(env); err != nil {
+			return fmt.Errorf("page %q: %w", page.Name, err)
+		}
+	}
+	return nil
+}
+
+func (page *layoutPage) check(env *formulaEnv) error {
+	if len(page.Rows) == 0 {
+		return errors.New("no rows")
+	}
+	for i := range page.Rows {
+		row := &page.Rows[i]
+		if row.Height < 0 {
+			return fmt.Errorf("row %d: height can't be negative", i+1)
+		}
+		if row.Height == 0 {
+			row.Height = 1
+		}
+		if len(row.Widgets) == 0 {
+			return fmt.Errorf("row %d: no widgets", i+1)
+		}
+		for j := range row.Widgets {
+			if err := row.Widgets[j].check(env); err != nil {
+				return fmt.Errorf("row %d, widget %d: %w", i+1, j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *layoutWidget) check(env *formulaEnv) error {
+	if w.Width < 0 {
+		return errors.New("width can't be negative")
+	}
+	if w.Width == 0 {
+		w.Width = 1
+	}
+
+	switch {
+	case w.Type == "link":
+		if !layoutLinkSources[w.Source] {
+			return fmt.Errorf("no link for source %q, expected mut or imfd", w.Source)
+		}
+	case dashboardWidgetTypes[w.Type].new != nil:
+		channels := w.channels()
+		if len(channels) == 0 {
+			return fmt.Errorf("a %s needs a channel", w.Type)
+		}
+		if len(channels) > 1 && !dashboardWidgetTypes[w.Type].multiChannel {
+			return fmt.Errorf("a %s shows one channel, not %d", w.Type, len(channels))
+		}
+		w.keys = nil
+		for _, channel := range channels {
+			key, err := env.channel(channel)
+			if err != nil {
+				return err
+			}
+			w.keys = append(w.keys, key)
+		}
+	default:
+		return fmt.Errorf("unknown widget type %q", w.Type)
+	}
+
+	if w.Window < 0 {
+		return errors.New("window can't be negative")
+	}
+	if _, ok := statNames[w.Stat]; w.Type == "stat" && !ok {
+		return fmt.Errorf("unknown stat %q, expected min, max, mean, average or above", w.Stat)
+	}
+	if w.Type == "stat" && w.Stat == "above" && w.Threshold == nil {
+		return errors.New("the time above needs a threshold")
+	}
+	if w.Samples < 0 || w.Samples > historyCapacity {
+		return fmt.Errorf("samples should be between 1 and %d", historyCapacity)
+	}
+	if len(w.Thresholds) > len(w.Channels) {
+		return fmt.Errorf("%d thresholds for %d channels", len(w.Thresholds), len(w.Channels))
+	}
+	if w.Min != nil && w.Max != nil && *w.Min >= *w.Max {
+		return fmt.Errorf("min (%g) should be below max (%g)", *w.Min, *w.Max)
+	}
+	if w.Format != "" && strings.Contains(fmt.Sprintf(w.Format, 1.0), "%!") {
+		return fmt.Errorf("format %q should have one verb for the value, like %%.1f", w.Format)
+	}
+	for _, colour := range append([]string{w.Colour, w.LabelColour, w.TitleColour, w.BorderColour}, w.Colours...) {
+		if _, ok := layoutColours[strings.ToLower(colour)]; colour != "" && !ok {
+			return fmt.Errorf("unknown colour %q", colour)
+		}
+	}
+	return nil
+}
+
+// Leave out any channel the profile doesn't have, along with any widgets, rows and pages that leaves empty
+func (layout *dashboardLayout) dropUnknownChannels(env *formulaEnv) {
+	known := func(channel string) bool {
+		_, err := env.channel(channel)
+		return err == nil
+	}
+	dropRows := func(rows []layoutRow) []layoutRow {
+		var kept []layoutRow
+		for _, row := range rows {
+			var widgets []layoutWidget
+			for _, w := range row.Widgets {
+				if w.Channel != "" && !known(w.Channel) {
+					continue
+				}
+				// Taking the colour and threshold for a channel with it, so the rest stay lined up
+				var channels, colours []string
+				var thresholds []*float64
+				for i, channel := range w.Channels {
+					if !known(channel) {
+						continue
+					}
+					channels = append(channels, channel)
+					if i < len(w.Colours) {
+						colours = append(colours, w.Colours[i])
+					}
+					if i < len(w.Thresholds) {
+						thresholds = append(thresholds, w.Thresholds[i])
+					}
+				}
+				if len(w.Channels) > 0 && len(channels) == 0 && w.Channel == "" {
+					continue
+				}
+				w.Channels, w.Colours, w.Thresholds = channels, colours, thresholds
+				widgets = append(widgets, w)
+			}
+			if len(widgets) > 0 {
+				row.Widgets = widgets
+				kept = append(kept, row)
+			}
+		}
+		return kept
+	}
+
+	layout.Rows = dropRows(layout.Rows)
+	var pages []layoutPage
+	for _, page := range layout.Pages {
+		if page.Rows = dropRows(page.Rows); len(page.Rows) > 0 {
+			pages = append(pages, page)
+		}
+	}
+	layout.Pages = pages
+}
+
+// The widget's title, the channel's name if the layout doesn't give one
+func (w *layoutWidget) title() string {
+	if w.Title != "" {
+		return w.Title
+	}
+	_, name := splitChannelKey(w.key())
+	return name
+}
+
+// How often the layout file is checked for changes
+const layoutPollInterval = time.Second
+
+// A layout read again after the file changed, or why it couldn't be
+type layoutUpdate struct {
+	layout *dashboardLayout
+	err    error
+}
+
+var layoutChannel = make(chan layoutUpdate, 1)
+
+// Keep an eye on the layout file until ctx is cancelled, reading it again
+// whenever it's been saved. Only the newest version matters, so one the
+// dashboard hasn't picked up yet is replaced.
+func watchLayout(ctx context.Context, path string) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(layoutPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Most likely the editor is halfway through replacing it
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+
+		layout, err := readDashboardLayout(path)
+		select {
+		case <-layoutChannel:
+		default:
+		}
+		select {
+		case layoutChannel <- layoutUpdate{layout, err}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EvoScan's Data.xml and the MitsuLogger definitions describe the same things with
+// slightly different attribute names, so look for any of them. EvoScan writes
+// <Mode2 Display="..." RequestID="21" Eval="x*31.25" Unit="rpm" .../> inside
+// <vehicle> and <ecu> elements, MitsuLogger uses Name/Request/Units.
+var (
+	loggerNameAttributes     = []string{"Display", "Name", "LogReference"}
+	loggerRequestAttributes  = []string{"RequestID", "RequestId", "Request", "Address"}
+	loggerEvalAttributes     = []string{"Eval", "Formula", "Expression"}
+	loggerUnitAttributes     = []string{"Unit", "Units"}
+	loggerMinAttributes      = []string{"GaugeMin", "ChartMin", "Min"}
+	loggerMaxAttributes      = []string{"GaugeMax", "ChartMax", "Max"}
+	loggerDecimalsAttributes = []string{"Decimals", "Precision"}
+)
+
+// Find the first of the attribute names that is present on the element
+func loggerAttribute(element xml.StartElement, names []string) (string, bool) {
+	for _, name := range names {
+		for _, attr := range element.Attr {
+			if strings.EqualFold(attr.Name.Local, name) {
+				return strings.TrimSpace(attr.Value), true
+			}
+		}
+	}
+	return "", false
+}
+
+// Import an EvoScan or MitsuLogger XML definition file as a sensor profile.
+//
+// The files usually cover several cars, so filter (if not empty) limits the import to
+// the definitions inside a <vehicle> or <ecu> whose name contains it.
+// Definitions we can't use (non MUT requests, formulas we don't understand) are
+// skipped and described in the returned warnings rather than failing the import.
+func importLoggerDefinitions(r io.Reader, filter string) (*sensorProfile, []string, error) {
+	profile := &sensorProfile{}
+	var warnings []string
+	seen := make(map[sensorId]string)
+	names := make(map[string]sensorId)
+
+	// The names of the <vehicle>/<ecu> sections we are inside of
+	var context []string
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, warnings, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			request, hasRequest := loggerAttribute(element, loggerRequestAttributes)
+			eval, hasEval := loggerAttribute(element, loggerEvalAttributes)
+			name, _ := loggerAttribute(element, loggerNameAttributes)
+
+			// Anything that isn't a sensor is a section, which may be named
+			if !hasRequest || !hasEval {
+				context = append(context, name)
+				if profile.Name == "" && name != "" && loggerContextMatches([]string{name}, filter) {
+					profile.Name = name
+				}
+				continue
+			}
+			context = append(context, "")
+
+			if !loggerContextMatches(context, filter) {
+				continue
+			}
+
+			definition, problems, err := loggerDefinition(element, name, request, eval)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("skipping %q: %v", name, err))
+				continue
+			}
+			if previous, exists := seen[definition.Id]; exists {
+				warnings = append(warnings, fmt.Sprintf("skipping %q: request 0x%02X is already used by %q", name, uint16(definition.Id), previous))
+				continue
+			}
+			// Channels go by name, so a second one called the same would get mixed up with the first
+			if previous, exists := names[definition.Name]; exists {
+				warnings = append(warnings, fmt.Sprintf("skipping %q: the name is already used by request 0x%02X", name, uint16(previous)))
+				continue
+			}
+			for _, problem := range problems {
+				warnings = append(warnings, fmt.Sprintf("%q: %s", name, problem))
+			}
+			seen[definition.Id] = definition.Name
+			names[definition.Name] = definition.Id
+			profile.Mut = append(profile.Mut, definition)
+		case xml.EndElement:
+			if len(context) > 0 {
+				context = context[:len(context)-1]
+			}
+		}
+	}
+
+	if len(profile.Mut) == 0 {
+		return nil, warnings, fmt.Errorf("no usable MUT definitions found")
+	}
+	if profile.Name == "" {
+		profile.Name = "imported"
+	}
+	profile.Description = "Imported logger definitions"
+
+	return profile, warnings, nil
+}
+
+// Whether any of the enclosing sections match the filter
+func loggerContextMatches(context []string, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, name := range context {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(filter)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Turn a single logger entry into one of our sensor definitions, along with
+// anything about it worth warning about that didn't stop it being imported
+func loggerDefinition(element xml.StartElement, name string, request string, eval string) (sensorDefinition, []string, error) {
+	definition := sensorDefinition{Name: name, Priority: "medium", Decimals: 1}
+	if name == "" {
+		return definition, nil, fmt.Errorf("no name")
+	}
+
+	// Request IDs are written in hex without a prefix, two byte sensors
+	// have both requests run together ("3839")
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(request), "0x"), 16, 16)
+	if err != nil {
+		return definition, nil, fmt.Errorf("request %q isn't a MUT request id", request)
+	}
+	if id > 0xFF {
+		lowId := sensorId(id & 0xFF)
+		definition.LowId = &lowId
+		id >>= 8
+	}
+	definition.Id = sensorId(id)
+
+	// EvoScan formulas are written with an upper or lower case x, optionally
+	// with a leading '=' as in a spreadsheet cell
+	definition.Formula = strings.TrimPrefix(eval, "=")
+	conversionFunction, err := compileFormula(definition.Formula, nil)
+	if err != nil {
+		return definition, nil, err
+	}
+
+	definition.Unit, _ = loggerAttribute(element, loggerUnitAttributes)
+
+	// EvoScan ranks sensors 1 (most often) and up, and has a DataLog switch to leave them out
+	if priority, ok := loggerAttribute(element, []string{"Priority"}); ok {
+		switch priority {
+		case "1":
+			definition.Priority = "high"
+		case "2":
+			definition.Priority = "medium"
+		default:
+			definition.Priority = "low"
+		}
+	}
+	if dataLog, ok := loggerAttribute(element, []string{"DataLog"}); ok && strings.EqualFold(dataLog, "N") {
+		definition.Priority = "none"
+	}
+
+	var warnings []string
+	if decimals, ok := loggerAttribute(element, loggerDecimalsAttributes); ok {
+		if d, err := strconv.Atoi(decimals); err == nil {
+			// More than a profile allows would fail the whole import, not just this one
+			definition.Decimals = min(max(d, 0), profileMaxDecimals)
+			if definition.Decimals != d {
+				warnings = append(warnings, fmt.Sprintf("%d decimals is out of range, using %d", d, definition.Decimals))
+			}
+		}
+	}
+
+	// Use the gauge range if there is one, otherwise work it out from the raw range
+	min, hasMin := loggerFloatAttribute(element, loggerMinAttributes)
+	max, hasMax := loggerFloatAttribute(element, loggerMaxAttributes)
+	if !hasMin || !hasMax || min >= max {
+		maxRaw := 0xFF
+		if definition.LowId != nil {
+			maxRaw = 0xFFFF
+		}
+		var ok bool
+		if min, max, ok = formulaRange(conversionFunction, maxRaw); !ok {
+			// Nothing but NaN and infinities, so there's no telling where the gauge
+			// should go. The raw range is as good a guess as any.
+			min, max = 0, float64(maxRaw)
+			warnings = append(warnings, fmt.Sprintf("formula %q never gives a number, using a range of %g to %g", definition.Formula, min, max))
+		}
+	}
+	definition.Min, definition.Max = min, max
+
+	return definition, warnings, nil
+}
+
+func loggerFloatAttribute(element xml.StartElement, names []string) (float64, bool) {
+	text, ok := loggerAttribute(element, names)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	return value, err == nil
+}
+
+// The smallest and largest finite values a conversion produces over the raw range,
+// or false if it doesn't produce any
+func formulaRange(conversionFunction func(float64) float64, maxRaw int) (float64, float64, bool) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for raw := 0; raw <= maxRaw; raw++ {
+		value := conversionFunction(float64(raw))
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			continue
+		}
+		min, max = math.Min(min, value), math.Max(max, value)
+	}
+	if math.IsInf(min, 1) {
+		return 0, 0, false
+	}
+	if min >= max {
+		// Constant conversion, give it some room so the profile is still valid
+		return min - 1, min + 1, true
+	}
+	return min, max, true
+}
+
+// Import a logger definition file given as "Data.xml" or "Data.xml#Evo 9",
+// borrowing the iMFD sensors from the built-in profile
+func readLoggerProfile(path string) (*sensorProfile, error) {
+	path, filter, _ := strings.Cut(path, "#")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profile, warnings, err := importLoggerDefinitions(f, filter)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, warning)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("importing %s: %w", path, err)
+	}
+
+	builtIn, err := readSensorProfile("")
+	if err != nil {
+		return nil, err
+	}
+	profile.Imfd = builtIn.Imfd
+
+	return profile, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Requests that return the two halves of the ECU ID
+const (
+	mutRequestEcuIdHigh byte = 0xFF
+	mutRequestEcuIdLow  byte = 0xFE
+)
+
+var (
+	errMutNoResponse    = errors.New("mut: no response from ECU")
+	errMutShortResponse = errors.New("mut: short response")
+	errMutNoEcho        = errors.New("mut: request was not echoed back")
+	errMutUnknownSensor = errors.New("mut: unknown sensor")
+)
+
+// Sensors whose value doesn't fit in a byte are read with two requests,
+// the first returning the high byte and the second the low byte.
+// This maps the sensor ID to the request for its low byte, and is
+// built from the sensor profile along with mutSensors.
+var mutWideSensors = map[uint16]byte{}
+
+// mutCodec knows how to turn a sensor ID into request bytes and pick
+// the value back out of whatever the ECU (and the cable) sends back
+type mutCodec struct {
+	// K-line is a single wire, so on most cables every byte we send
+	// comes straight back to us before the ECU's answer
+	echo bool
+}
+
+// The request bytes needed to read a sensor, high byte first
+func mutRequestBytes(sensorId uint16) []byte {
+	request := []byte{byte(sensorId)}
+	if lowByte, ok := mutWideSensors[sensorId]; ok {
+		request = append(request, lowByte)
+	}
+	return request
+}
+
+// How many bytes come back for a single request byte
+func (c mutCodec) responseLength() int {
+	if c.echo {
+		return 2
+	}
+	return 1
+}
+
+// Pick the ECU's answer out of the bytes read back after sending request
+func (c mutCodec) decodeResponse(request byte, response []byte) (byte, error) {
+	if len(response) < c.responseLength() {
+		if len(response) == 0 || (c.echo && len(response) == 1 && response[0] == request) {
+			return 0, errMutNoResponse
+		}
+		return 0, fmt.Errorf("%w to 0x%02X: % X", errMutShortResponse, request, response)
+	}
+
+	if c.echo {
+		if response[0] != request {
+			return 0, fmt.Errorf("%w: sent 0x%02X, got 0x%02X", errMutNoEcho, request, response[0])
+		}
+		return response[1], nil
+	}
+
+	return response[0], nil
+}
+
+// Send a single request byte and return the ECU's answer
+func mutExchange(transport ecuTransport, codec mutCodec, request byte) (byte, error) {
+	if err := transport.WriteRequest([]byte{request}); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, codec.responseLength())
+	n, err := transport.ReadResponse(response, mutResponseTimeout)
+	if err != nil && err != errTransportTimeout {
+		return 0, err
+	}
+
+	return codec.decodeResponse(request, response[:n])
+}
+
+// Read a sensor, combining both halves of the wide sensors into one value
+func mutReadSensor(transport ecuTransport, codec mutCodec, sensorId uint16) (uint16, error) {
+	var value uint16
+	for _, request := range mutRequestBytes(sensorId) {
+		b, err := mutExchange(transport, codec, request)
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | uint16(b)
+	}
+	return value, nil
+}
+
+// Work out whether the cable echoes what we send by asking for the first half of
+// the ECU ID and looking at what comes back. Returns the codec to use from then on
+// along with the ID byte.
+func mutDetectEcho(transport ecuTransport) (mutCodec, byte, error) {
+	if err := transport.WriteRequest([]byte{mutRequestEcuIdHigh}); err != nil {
+		return mutCodec{}, 0, err
+	}
+
+	// Ask for two bytes, an echoing cable fills both, otherwise we time out with one
+	var response [2]byte
+	n, err := transport.ReadResponse(response[:], mutResponseTimeout)
+	if err != nil && err != errTransportTimeout {
+		return mutCodec{}, 0, err
+	}
+
+	switch {
+	case n == 2 && response[0] == mutRequestEcuIdHigh:
+		return mutCodec{echo: true}, response[1], nil
+	case n == 1 && response[0] == mutRequestEcuIdHigh:
+		// Just our request coming back, an echoing cable with an ECU too slow to
+		// answer in time. Taking it for the ID would have every read after this
+		// return the request byte, so give up and let the session start over.
+		return mutCodec{}, 0, errMutNoResponse
+	case n == 1:
+		return mutCodec{echo: false}, response[0], nil
+	case n == 0:
+		return mutCodec{}, 0, errMutNoResponse
+	}
+
+	return mutCodec{}, 0, fmt.Errorf("mut: unexpected handshake response % X", response[:n])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A transport that plays back what a cable sent us, one recorded reply per read.
+// A reply shorter than the read times out, like the real thing.
+type recordedTransport struct {
+	replies [][]byte
+	readErr error
+
+	// Everything written to it, a request per write
+	written [][]byte
+}
+
+func (t *recordedTransport) WriteRequest(data []byte) error {
+	t.written = append(t.written, append([]byte(nil), data...))
+	return nil
+}
+
+func (t *recordedTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	if t.readErr != nil {
+		return 0, t.readErr
+	}
+	if len(t.replies) == 0 {
+		return 0, errTransportTimeout
+	}
+	reply := t.replies[0]
+	t.replies = t.replies[1:]
+	n := copy(buf, reply)
+	if n < len(buf) {
+		return n, errTransportTimeout
+	}
+	return n, nil
+}
+
+func (t *recordedTransport) SlowInit() error { return nil }
+func (t *recordedTransport) Purge() error    { return nil }
+func (t *recordedTransport) Close() error    { return nil }
+func (t *recordedTransport) String() string  { return "recorded" }
+
+var errRecordedUnplugged = errors.New("cable unplugged")
+
+func TestMutDetectEcho(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies [][]byte
+		readErr error
+		echo    bool
+		id      byte
+		err     error
+	}{
+		{name: "echoing cable", replies: [][]byte{{0xFF, 0x98}}, echo: true, id: 0x98},
+		{name: "non-echoing cable", replies: [][]byte{{0x98}}, echo: false, id: 0x98},
+		{name: "echo but the ECU is too slow", replies: [][]byte{{0xFF}}, err: errMutNoResponse},
+		{name: "nothing at all", err: errMutNoResponse},
+		{name: "garbage", replies: [][]byte{{0x12, 0x34}}, err: errors.New("any")},
+		{name: "read fails", readErr: errRecordedUnplugged, err: errRecordedUnplugged},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &recordedTransport{replies: test.replies, readErr: test.readErr}
+			codec, id, err := mutDetectEcho(transport)
+			if !bytes.Equal(transport.written[0], []byte{mutRequestEcuIdHigh}) {
+				t.Errorf("wrote % X, want FF", transport.written[0])
+			}
+			if test.err != nil {
+				if err == nil {
+					t.Fatalf("got codec %+v and ID 0x%02X, want an error", codec, id)
+				}
+				if test.err.Error() != "any" && !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.echo != test.echo || id != test.id {
+				t.Errorf("got echo %t and ID 0x%02X, want %t and 0x%02X", codec.echo, id, test.echo, test.id)
+			}
+		})
+	}
+}
+
+func TestMutExchange(t *testing.T) {
+	tests := []struct {
+		name    string
+		echo    bool
+		replies [][]byte
+		readErr error
+		value   byte
+		err     error
+	}{
+		{name: "echoing", echo: true, replies: [][]byte{{0x21, 0x5A}}, value: 0x5A},
+		{name: "non-echoing", echo: false, replies: [][]byte{{0x5A}}, value: 0x5A},
+		{name: "echoing, only the echo", echo: true, replies: [][]byte{{0x21}}, err: errMutNoResponse},
+		{name: "echoing, nothing", echo: true, err: errMutNoResponse},
+		{name: "non-echoing, nothing", echo: false, err: errMutNoResponse},
+		{name: "echoing, one byte that isn't the echo", echo: true, replies: [][]byte{{0x5A}}, err: errMutShortResponse},
+		{name: "echoing, wrong echo", echo: true, replies: [][]byte{{0x22, 0x5A}}, err: errMutNoEcho},
+		{name: "read fails", echo: true, readErr: errRecordedUnplugged, err: errRecordedUnplugged},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &recordedTransport{replies: test.replies, readErr: test.readErr}
+			value, err := mutExchange(transport, mutCodec{echo: test.echo}, 0x21)
+			if len(transport.written) != 1 || !bytes.Equal(transport.written[0], []byte{0x21}) {
+				t.Errorf("wrote % X, want a single 21", transport.written)
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got 0x%02X and error %v, want %v", value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.value {
+				t.Errorf("got 0x%02X, want 0x%02X", value, test.value)
+			}
+		})
+	}
+}
+
+func TestMutReadSensor(t *testing.T) {
+	// Injector pulse width is 16 bits, the high byte from 0x29 and the low from 0x2A
+	saved := mutWideSensors
+	mutWideSensors = map[uint16]byte{0x29: 0x2A}
+	t.Cleanup(func() { mutWideSensors = saved })
+
+	tests := []struct {
+		name     string
+		echo     bool
+		sensorId uint16
+		replies  [][]byte
+		requests [][]byte
+		value    uint16
+		err      error
+	}{
+		{name: "8-bit, echoing", echo: true, sensorId: 0x21, replies: [][]byte{{0x21, 0x80}},
+			requests: [][]byte{{0x21}}, value: 0x80},
+		{name: "8-bit, non-echoing", sensorId: 0x21, replies: [][]byte{{0x80}},
+			requests: [][]byte{{0x21}}, value: 0x80},
+		{name: "16-bit, echoing", echo: true, sensorId: 0x29, replies: [][]byte{{0x29, 0x12}, {0x2A, 0x34}},
+			requests: [][]byte{{0x29}, {0x2A}}, value: 0x1234},
+		{name: "16-bit, non-echoing", sensorId: 0x29, replies: [][]byte{{0x12}, {0x34}},
+			requests: [][]byte{{0x29}, {0x2A}}, value: 0x1234},
+		{name: "16-bit, no low byte", echo: true, sensorId: 0x29, replies: [][]byte{{0x29, 0x12}, {0x2A}},
+			requests: [][]byte{{0x29}, {0x2A}}, err: errMutNoResponse},
+		{name: "16-bit, no high byte", sensorId: 0x29,
+			requests: [][]byte{{0x29}}, err: errMutNoResponse},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &recordedTransport{replies: test.replies}
+			value, err := mutReadSensor(transport, mutCodec{echo: test.echo}, test.sensorId)
+			if len(transport.written) != len(test.requests) {
+				t.Fatalf("wrote % X, want % X", transport.written, test.requests)
+			}
+			for i := range test.requests {
+				if !bytes.Equal(transport.written[i], test.requests[i]) {
+					t.Errorf("request %d was % X, want % X", i, transport.written[i], test.requests[i])
+				}
+			}
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got 0x%04X and error %v, want %v", value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.value {
+				t.Errorf("got 0x%04X, want 0x%04X", value, test.value)
+			}
+		})
+	}
+}
+
+func TestMutDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		echo     bool
+		response []byte
+		value    byte
+		err      error
+	}{
+		{name: "echoed", echo: true, response: []byte{0x21, 0x00}, value: 0x00},
+		{name: "echoed, answer matches the request", echo: true, response: []byte{0x21, 0x21}, value: 0x21},
+		{name: "not echoed", response: []byte{0xFF}, value: 0xFF},
+		{name: "empty, echoing", echo: true, response: nil, err: errMutNoResponse},
+		{name: "empty, not echoing", response: nil, err: errMutNoResponse},
+		{name: "just the echo", echo: true, response: []byte{0x21}, err: errMutNoResponse},
+		{name: "short", echo: true, response: []byte{0x40}, err: errMutShortResponse},
+		{name: "bad echo", echo: true, response: []byte{0x40, 0x01}, err: errMutNoEcho},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := mutCodec{echo: test.echo}.decodeResponse(0x21, test.response)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got 0x%02X and error %v, want %v", value, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != test.value {
+				t.Errorf("got 0x%02X, want 0x%02X", value, test.value)
+			}
+		})
+	}
+}
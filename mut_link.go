@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The state of the link to a data source, as shown on the dashboard
+type linkState int
+
+const (
+	linkConnecting linkState = iota
+	linkUp
+	linkDegraded
+	linkAsleep
+	linkDown
+)
+
+func (s linkState) String() string {
+	switch s {
+	case linkConnecting:
+		return "Connecting"
+	case linkUp:
+		return "Up"
+	case linkDegraded:
+		return "Degraded"
+	case linkAsleep:
+		return "ECU Asleep"
+	case linkDown:
+		return "Down"
+	}
+	return "Unknown"
+}
+
+// A change in link state, along with whatever caused it
+type linkStatus struct {
+	source string
+	state  linkState
+	detail string
+}
+
+var linkStatusChannel = make(chan linkStatus, 16)
+
+// Let the UI know the link has changed state, without ever blocking the stream on it
+func reportLinkStatus(status linkStatus) {
+	log.Printf("[%s link] %s: %s", status.source, status.state, status.detail)
+	select {
+	case linkStatusChannel <- status:
+	default:
+	}
+}
+
+// How long to wait between reconnect attempts, doubling each time up to the max
+const (
+	mutReconnectMinBackoff = 500 * time.Millisecond
+	mutReconnectMaxBackoff = 10 * time.Second
+)
+
+// How many requests in a row can go unanswered before we call the link
+// degraded, and before we decide the ECU has gone to sleep (usually key-off)
+const (
+	mutDegradedAfter = 3
+	mutAsleepAfter   = 20
+)
+
+var errMutEcuAsleep = errors.New("mut: ECU stopped responding")
+
+// What kind of failure an error from the MUT stream is
+type mutFault int
+
+const (
+	// The ECU didn't answer (or only partly answered) this request
+	mutFaultTimeout mutFault = iota
+	// The cable didn't echo our request back, usually noise on the line
+	mutFaultNoEcho
+	// The transport itself failed, the cable has most likely been pulled out
+	mutFaultUnplugged
+)
+
+func classifyMutError(err error) mutFault {
+	switch {
+	case errors.Is(err, errTransportTimeout), errors.Is(err, errMutNoResponse), errors.Is(err, errMutShortResponse):
+		return mutFaultTimeout
+	case errors.Is(err, errMutNoEcho):
+		return mutFaultNoEcho
+	}
+	return mutFaultUnplugged
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > mutReconnectMaxBackoff {
+		return mutReconnectMaxBackoff
+	}
+	return backoff
+}
+
+// Keeps track of how well the ECU is answering, deciding when a
+// run of errors means the session has to be torn down and started again
+type mutLinkHealth struct {
+	transport ecuTransport
+	misses    int
+}
+
+// Record the outcome of a request. Returns an error if the link is gone.
+func (h *mutLinkHealth) record(err error) error {
+	if err == nil {
+		if h.misses >= mutDegradedAfter {
+			reportLinkStatus(linkStatus{"mut", linkUp, h.transport.String()})
+		}
+		h.misses = 0
+		return nil
+	}
+
+	if classifyMutError(err) == mutFaultUnplugged {
+		return err
+	}
+
+	// Throw away anything half received so the next request starts clean,
+	// if we can't even do that then the transport has gone away
+	if purgeErr := h.transport.Purge(); purgeErr != nil {
+		return purgeErr
+	}
+
+	h.misses++
+	if h.misses == mutDegradedAfter {
+		reportLinkStatus(linkStatus{"mut", linkDegraded, err.Error()})
+	}
+	if h.misses >= mutAsleepAfter {
+		return fmt.Errorf("%w after %d missed responses", errMutEcuAsleep, h.misses)
+	}
+
+	return nil
+}
+
+// Sleep for d, returning false (early) if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often each priority is polled (in Hz) when a sensor doesn't set its own rate.
+// The K-line only manages a hundred or so requests a second, so these
+// are deliberately modest, see mutScheduler for what happens when they don't fit.
+var mutPriorityRates = map[string]float64{
+	"high":   15,
+	"medium": 5,
+	"low":    1,
+}
+
+// The highest rate a sensor can ask for, well past what the bus can actually do
+const mutMaxRate = 100
+
+// How often the achieved rates are worked out and reported
+const mutRateReportInterval = 5 * time.Second
+
+// How long to sit idle when there is nothing to poll at all
+const mutSchedulerIdle = 100 * time.Millisecond
+
+// How often sensors nobody is looking at are still polled (in Hz), slow
+// enough to stay out of the way but often enough not to be stale if they're needed
+const mutBackgroundRate = 0.5
+
+// The rate each sensor should be polled at, given its own rate from the profile and
+// what the subscribers want. Shown sensors are boosted to at least the high priority
+// rate (even priority "none" ones, if somebody put one on screen), alarms and logs keep
+// theirs, and anything nobody wants is demoted to the background rate.
+// With no subscribers at all, every sensor is polled at its own rate.
+func mutPollPlan(sensors map[uint16]mutSensor, levels map[string]demandLevel, subscribed bool) map[uint16]float64 {
+	rates := make(map[uint16]float64, len(sensors))
+	for sensorId, sensor := range sensors {
+		rate := sensor.rate
+		if subscribed {
+			switch levels[channelKey("mut", sensor.name)] {
+			case demandVisible:
+				rate = math.Max(rate, mutPriorityRates["high"])
+			case demandAlarm:
+				rate = math.Max(rate, mutPriorityRates["medium"])
+			case demandLogged:
+				rate = math.Max(rate, mutPriorityRates["low"])
+			default:
+				rate = math.Min(rate, mutBackgroundRate)
+			}
+		}
+		if rate > 0 {
+			rates[sensorId] = rate
+		}
+	}
+	return rates
+}
+
+func rateInterval(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// A sensor waiting its turn on the bus
+type sensorRequest struct {
+	sensorId uint16
+	interval time.Duration
+	due      time.Time
+}
+
+// Sensor Queue, ordered by when each sensor is next due
+type sensorQueue []*sensorRequest
+
+func (pq sensorQueue) Len() int { return len(pq) }
+
+func (pq sensorQueue) Less(i, j int) bool {
+	if !pq[i].due.Equal(pq[j].due) {
+		return pq[i].due.Before(pq[j].due)
+	}
+	// Faster sensors win ties
+	return pq[i].interval < pq[j].interval
+}
+
+func (pq sensorQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+}
+
+func (pq *sensorQueue) Push(x interface{}) {
+	item := x.(*sensorRequest)
+	*pq = append(*pq, item)
+}
+
+func (pq *sensorQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[0 : n-1]
+	return item
+}
+
+// Decides which sensor goes on the bus next. Every sensor is due once per interval
+// (1/rate) and the one that has been due the longest goes first, one request at a time.
+//
+// When the sensors ask for more than the bus can carry, every sensor falls behind
+// at the same pace in wall clock terms, which means each one still gets a share of the
+// bus in proportion to its rate: RPM at 15 Hz keeps getting fifteen times the
+// requests of something at 1 Hz, it's just that neither gets what it asked for.
+type mutScheduler struct {
+	queue sensorQueue
+
+	// Smoothed time for a sensor read to make it there and back
+	rtt time.Duration
+
+	// What has been achieved since the last report
+	windowStart time.Time
+	completed   map[uint16]int
+	busy        time.Duration
+}
+
+func newMutScheduler(rates map[uint16]float64, now time.Time) *mutScheduler {
+	s := &mutScheduler{windowStart: now, completed: make(map[uint16]int)}
+	s.update(rates, now)
+	return s
+}
+
+// Switch to a new polling plan. Sensors that are sped up are brought forward
+// so the change shows straight away, sensors without a rate are dropped.
+func (s *mutScheduler) update(rates map[uint16]float64, now time.Time) {
+	queue := make(sensorQueue, 0, len(rates))
+	queued := make(map[uint16]bool, len(rates))
+	for _, request := range s.queue {
+		rate, wanted := rates[request.sensorId]
+		if !wanted {
+			continue
+		}
+		request.interval = rateInterval(rate)
+		if latest := now.Add(request.interval); request.due.After(latest) {
+			request.due = latest
+		}
+		queue = append(queue, request)
+		queued[request.sensorId] = true
+	}
+
+	// Whatever is left is new to the plan
+	for sensorId, rate := range rates {
+		if !queued[sensorId] {
+			queue = append(queue, &sensorRequest{sensorId: sensorId, interval: rateInterval(rate), due: now})
+		}
+	}
+
+	s.queue = queue
+	heap.Init(&s.queue)
+}
+
+// The next sensor to poll, or nil and how long until one is due
+func (s *mutScheduler) next(now time.Time) (*sensorRequest, time.Duration) {
+	if s.queue.Len() == 0 {
+		return nil, mutSchedulerIdle
+	}
+	if wait := s.queue[0].due.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	return heap.Pop(&s.queue).(*sensorRequest), 0
+}
+
+// Put a sensor back in the queue once its request has been answered (or not),
+// keeping track of how long the bus took
+func (s *mutScheduler) done(request *sensorRequest, started time.Time, finished time.Time, err error) {
+	elapsed := finished.Sub(started)
+	s.busy += elapsed
+	if err == nil {
+		s.completed[request.sensorId]++
+
+		// An exponential moving average, so one slow answer doesn't throw it out
+		if s.rtt == 0 {
+			s.rtt = elapsed
+		} else {
+			s.rtt += (elapsed - s.rtt) / 8
+		}
+	}
+
+	// Due one interval after it was last due, not after it was polled, so a
+	// sensor that was held up isn't penalised for it. But not before now: one
+	// that fell a long way behind (while the link was stalled, say) would
+	// otherwise be polled back to back until it had caught up on every interval.
+	request.due = request.due.Add(request.interval)
+	if request.due.Before(finished) {
+		request.due = finished
+	}
+	heap.Push(&s.queue, request)
+}
+
+// What the scheduler managed over a report interval
+type mutPollReport struct {
+	// Successful sensor reads per second, across all sensors
+	total float64
+
+	// The achieved rate of each sensor, alongside the rate it asked for
+	achieved map[uint16]float64
+	target   map[uint16]float64
+
+	rtt time.Duration
+
+	// How much of the time the bus was in use, 0..1
+	utilisation float64
+}
+
+// A summary for the dashboard
+func (r mutPollReport) String() string {
+	return fmt.Sprintf("%.0f req/s %.1fms", r.total, float64(r.rtt)/float64(time.Millisecond))
+}
+
+// Work out the achieved rates once every report interval, returning false in between
+func (s *mutScheduler) report(now time.Time) (mutPollReport, bool) {
+	elapsed := now.Sub(s.windowStart)
+	if elapsed < mutRateReportInterval {
+		return mutPollReport{}, false
+	}
+
+	report := mutPollReport{
+		achieved:    make(map[uint16]float64, len(s.queue)),
+		target:      make(map[uint16]float64, len(s.queue)),
+		rtt:         s.rtt,
+		utilisation: float64(s.busy) / float64(elapsed),
+	}
+	for _, request := range s.queue {
+		achieved := float64(s.completed[request.sensorId]) / elapsed.Seconds()
+		report.achieved[request.sensorId] = achieved
+		report.target[request.sensorId] = float64(time.Second) / float64(request.interval)
+		report.total += achieved
+	}
+
+	s.windowStart, s.busy = now, 0
+	s.completed = make(map[uint16]int, len(s.completed))
+	return report, true
+}
+
+var mutPollChannel = make(chan mutPollReport, 4)
+
+// Log the achieved rates and pass them on to the dashboard, without blocking the stream on it
+func reportMutPoll(report mutPollReport) {
+	sensorIds := make([]uint16, 0, len(report.achieved))
+	for sensorId := range report.achieved {
+		sensorIds = append(sensorIds, sensorId)
+	}
+	sort.Slice(sensorIds, func(i, j int) bool { return sensorIds[i] < sensorIds[j] })
+
+	sensorTablesMu.RLock()
+	rates := make([]string, 0, len(sensorIds))
+	for _, sensorId := range sensorIds {
+		rates = append(rates, fmt.Sprintf("%s %.1f/%.0f Hz", mutSensors[sensorId].name, report.achieved[sensorId], report.target[sensorId]))
+	}
+	sensorTablesMu.RUnlock()
+
+	log.Printf("[MUT poll] %.1f req/s, rtt %s, bus %.0f%% busy: %s", report.total, report.rtt, report.utilisation*100, strings.Join(rates, ", "))
+
+	select {
+	case mutPollChannel <- report:
+	default:
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ECU ID the simulator answers the 0xFF/0xFE handshake with
+var mutSimEcuId = [2]byte{0x4D, 0x53}
+
+// How long the simulated ECU takes to answer a request.
+// One byte at 15625 baud is 640µs, so a request and its reply is a little over a millisecond.
+const mutSimLatency = 1500 * time.Microsecond
+
+// The waveforms the simulator runs when it isn't given a script.
+// Every eight seconds the "car" does a pull from idle to redline,
+// spooling the turbo half way through and knocking just before the shift.
+const defaultMutSimScript = `
+Engine RPM:            sweep 800 7000 8s
+Speed:                 sweep 20 140 8s
+Throttle Position:     spool 5 100 8s
+Engine Load:           spool 20 150 8s
+Boost (MDP):           spool 0 22 8s
+Air Flow Meter:        sweep 30 1400 8s
+Air/Fuel Ratio (Map):  spool 14.7 11.2 8s
+Timing Advance:        sweep 25 12 8s
+Timing:                sweep 25 12 8s
+Knock Sum:             burst 0 6 8s 400ms
+Injector Pulse Width:  spool 2.5 14 8s
+Coolant Temp:          constant 88
+Coolant Temp Scaled:   constant 88
+MAF Air Temp:          sine 25 35 60s
+Battery Level:         sine 13.8 14.4 5s
+`
+
+// A simulated sensor output, in the sensor's own units (RPM, PSI, °C...)
+type simWaveform struct {
+	kind   string
+	low    float64
+	high   float64
+	period time.Duration
+	width  time.Duration
+}
+
+// Work out where the waveform is at time t
+func (w simWaveform) valueAt(t time.Duration) float64 {
+	if w.kind == "constant" || w.period <= 0 {
+		return w.low
+	}
+
+	// How far through the current cycle we are, 0..1
+	phase := float64(t%w.period) / float64(w.period)
+	span := w.high - w.low
+
+	switch w.kind {
+	case "sine":
+		return w.low + span*(1+math.Sin(2*math.Pi*phase))/2
+	case "sweep":
+		return w.low + span*phase
+	case "spool":
+		// Nothing for the first 30% of the cycle, build through to 60%, then hold
+		switch {
+		case phase < 0.3:
+			return w.low
+		case phase > 0.6:
+			return w.high
+		}
+		x := (phase - 0.3) / 0.3
+		return w.low + span*x*x*(3-2*x)
+	case "burst":
+		// Sit at low, jumping to high for the last 'width' of every cycle
+		if t%w.period >= w.period-w.width {
+			return w.high
+		}
+		return w.low
+	}
+
+	return w.low
+}
+
+// Parse a simulator script. Each line binds a sensor (by its name in tables or hex
+// request ID) to a waveform, or turns on the K-line echo:
+//
+//	Engine RPM:   sweep 800 7000 8s
+//	0x26:         burst 0 6 8s 400ms
+//	Coolant Temp: constant 88
+//	echo:         on
+//
+// Blank lines and lines starting with # are ignored.
+func parseMutSimScript(r io.Reader, tables *sensorTables) (*mutSimulator, error) {
+	// Build a reverse lookup so sensors can be referred to by name
+	sensorIds := make(map[string]uint16, len(tables.mut))
+	for sensorId, sensor := range tables.mut {
+		sensorIds[strings.ToLower(sensor.name)] = sensorId
+	}
+
+	sim := newMutSimulator(tables, make(map[uint16]simWaveform))
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Split "name: kind args..." on the last colon, sensor names don't contain one
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected 'sensor: waveform'", lineNumber)
+		}
+		name := strings.TrimSpace(line[:i])
+		fields := strings.Fields(line[i+1:])
+
+		if name == "echo" {
+			if len(fields) != 1 || (fields[0] != "on" && fields[0] != "off") {
+				return nil, fmt.Errorf("line %d: expected 'echo: on' or 'echo: off'", lineNumber)
+			}
+			sim.echo = fields[0] == "on"
+			continue
+		}
+
+		sensorId, ok := sensorIds[strings.ToLower(name)]
+		if !ok {
+			id, err := strconv.ParseUint(name, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: unknown sensor %q", lineNumber, name)
+			}
+			sensorId = uint16(id)
+		}
+
+		waveform, err := parseSimWaveform(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		sim.waveforms[sensorId] = waveform
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sim.invert()
+	return sim, nil
+}
+
+func parseSimWaveform(fields []string) (simWaveform, error) {
+	if len(fields) == 0 {
+		return simWaveform{}, fmt.Errorf("missing waveform")
+	}
+
+	// How many arguments each kind of waveform takes
+	arity := map[string]int{"constant": 1, "sine": 3, "sweep": 3, "spool": 3, "burst": 4}
+
+	waveform := simWaveform{kind: fields[0]}
+	args := fields[1:]
+	want, ok := arity[waveform.kind]
+	if !ok {
+		return waveform, fmt.Errorf("unknown waveform %q", waveform.kind)
+	}
+	if len(args) != want {
+		return waveform, fmt.Errorf("%s takes %d argument(s), got %d", waveform.kind, want, len(args))
+	}
+
+	var err error
+	if waveform.low, err = strconv.ParseFloat(args[0], 64); err != nil {
+		return waveform, err
+	}
+	if want == 1 {
+		return waveform, nil
+	}
+	if waveform.high, err = strconv.ParseFloat(args[1], 64); err != nil {
+		return waveform, err
+	}
+	if waveform.period, err = time.ParseDuration(args[2]); err != nil {
+		return waveform, err
+	}
+	if want == 4 {
+		if waveform.width, err = time.ParseDuration(args[3]); err != nil {
+			return waveform, err
+		}
+	}
+
+	return waveform, nil
+}
+
+// A simulated MUT-II ECU. It answers the same byte protocol as the real thing:
+// nothing until it has been woken up with the slow init, then 0xFF/0xFE
+// return the ECU ID and any other byte returns the current value of that sensor.
+type mutSimulator struct {
+	mu        sync.Mutex
+	awake     bool
+	echo      bool
+	started   time.Time
+	waveforms map[uint16]simWaveform
+
+	// The conversion of each scripted sensor run backwards, worked out when the script's loaded
+	inverses map[uint16]rawInverse
+
+	// The sensors of the car being simulated, which don't change
+	// when the dashboard swaps profiles after the handshake
+	tables *sensorTables
+}
+
+func newMutSimulator(tables *sensorTables, waveforms map[uint16]simWaveform) *mutSimulator {
+	return &mutSimulator{started: time.Now(), waveforms: waveforms, tables: tables}
+}
+
+// Work out the inverse of every scripted sensor's conversion, over all 16 bits for the
+// wide ones. Done once the script's been read, since that's what says which are scripted.
+func (s *mutSimulator) invert() {
+	s.inverses = make(map[uint16]rawInverse, len(s.waveforms))
+	for sensorId := range s.waveforms {
+		sensor, known := s.tables.mut[sensorId]
+		if !known {
+			continue
+		}
+		maxRaw := 0xFF
+		if _, wide := s.tables.wide[sensorId]; wide {
+			maxRaw = 0xFFFF
+		}
+		s.inverses[sensorId] = newRawInverse(sensor.conversionFunction, maxRaw)
+	}
+}
+
+// Load the simulator script from a file, or the default script if the path is empty
+func loadMutSimulator(scriptPath string) (*mutSimulator, error) {
+	var script io.Reader = strings.NewReader(defaultMutSimScript)
+	if scriptPath != "" {
+		f, err := os.Open(scriptPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		script = f
+	}
+
+	// The simulated car is the one the built-in profile describes
+	profile, err := readSensorProfile("")
+	if err != nil {
+		return nil, err
+	}
+	tables, err := profile.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	sim, err := parseMutSimScript(script, tables)
+	if err != nil {
+		return nil, fmt.Errorf("simulator script: %w", err)
+	}
+	return sim, nil
+}
+
+// Wake the ECU up, as if it had just seen 0x00 at 5 baud
+func (s *mutSimulator) wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.awake = true
+}
+
+// Work out what the ECU would send back for a request byte.
+// The second return value is false if the ECU wouldn't answer at all.
+func (s *mutSimulator) respond(request byte) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.awake {
+		return 0, false
+	}
+
+	switch request {
+	case 0xFF:
+		return mutSimEcuId[0], true
+	case 0xFE:
+		return mutSimEcuId[1], true
+	}
+
+	return s.rawValue(uint16(request), time.Since(s.started)), true
+}
+
+// Everything that comes back down the wire after sending request,
+// which on an echoing K-line starts with the request itself
+func (s *mutSimulator) replies(request byte) []byte {
+	var replies []byte
+	if s.echo {
+		replies = append(replies, request)
+	}
+	if reply, ok := s.respond(request); ok {
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// Find the raw byte for a sensor at a point in time, by running the waveform
+// backwards through the sensor's conversion function
+func (s *mutSimulator) rawValue(sensorId uint16, at time.Duration) byte {
+	// The low byte request of a wide sensor answers with the bottom half of that sensor
+	lowHalf := false
+	for wideSensorId, lowByte := range s.tables.wide {
+		if uint16(lowByte) == sensorId {
+			sensorId, lowHalf = wideSensorId, true
+		}
+	}
+
+	waveform, ok := s.waveforms[sensorId]
+	inverse, known := s.inverses[sensorId]
+	if !ok || !known {
+		// Nothing scripted, so sit in the middle of the range
+		return 0x80
+	}
+
+	if _, wide := s.tables.wide[sensorId]; wide {
+		raw := inverse.rawFor(waveform.valueAt(at))
+		if lowHalf {
+			return byte(raw)
+		}
+		return byte(raw >> 8)
+	}
+
+	return byte(inverse.rawFor(waveform.valueAt(at)))
+}
+
+// The conversion functions aren't all invertible (or even monotonic), so to run a
+// value backwards through one we convert every raw value once, up front, and keep
+// them sorted by what they convert to. Looking a value up is then a binary search
+// rather than 65536 conversions on every request.
+type rawInverse struct {
+	values []float64
+	raws   []int
+}
+
+func newRawInverse(conversionFunction func(float64) float64, maxRaw int) rawInverse {
+	type conversion struct {
+		value float64
+		raw   int
+	}
+	conversions := make([]conversion, 0, maxRaw+1)
+	for raw := 0; raw <= maxRaw; raw++ {
+		value := conversionFunction(float64(raw))
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		conversions = append(conversions, conversion{value, raw})
+	}
+	sort.SliceStable(conversions, func(i, j int) bool { return conversions[i].value < conversions[j].value })
+
+	// Where several raw values convert to the same thing, only the lowest is any use
+	var inverse rawInverse
+	for _, c := range conversions {
+		if n := len(inverse.values); n > 0 && inverse.values[n-1] == c.value {
+			continue
+		}
+		inverse.values = append(inverse.values, c.value)
+		inverse.raws = append(inverse.raws, c.raw)
+	}
+	return inverse
+}
+
+// Find the raw value that converts to the closest value to target,
+// the lower of the two if it falls exactly halfway
+func (inverse rawInverse) rawFor(target float64) int {
+	if len(inverse.values) == 0 || math.IsNaN(target) {
+		return 0
+	}
+	i := sort.SearchFloat64s(inverse.values, target)
+	switch {
+	case i == 0:
+		return inverse.raws[0]
+	case i == len(inverse.values):
+		return inverse.raws[i-1]
+	}
+	below, above := target-inverse.values[i-1], inverse.values[i]-target
+	if below < above || (below == above && inverse.raws[i-1] < inverse.raws[i]) {
+		return inverse.raws[i-1]
+	}
+	return inverse.raws[i]
+}
+
+// Serve the simulator over a byte stream such as a pty, answering each
+// request byte as it arrives. Returns when the stream is closed.
+func serveMutSimulator(sim *mutSimulator, port io.ReadWriter) error {
+	buf := make([]byte, 64)
+	for {
+		n, err := port.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		replies := make([]byte, 0, 2*n)
+		for _, request := range buf[:n] {
+			replies = append(replies, sim.replies(request)...)
+		}
+
+		if len(replies) > 0 {
+			time.Sleep(mutSimLatency)
+			if _, err := port.Write(replies); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// In-memory transport connected straight to a simulator
+
+type simTransport struct {
+	sim     *mutSimulator
+	replies chan byte
+}
+
+func newSimTransport(sim *mutSimulator) *simTransport {
+	return &simTransport{sim, make(chan byte, 256)}
+}
+
+func (t *simTransport) WriteRequest(data []byte) error {
+	for _, request := range data {
+		for _, reply := range t.sim.replies(request) {
+			select {
+			case t.replies <- reply:
+			default:
+				// Nobody is reading the replies, a real UART would overrun too
+			}
+		}
+	}
+	return nil
+}
+
+func (t *simTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	time.Sleep(mutSimLatency)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	n := 0
+	for n < len(buf) {
+		select {
+		case b := <-t.replies:
+			buf[n] = b
+			n++
+		case <-deadline.C:
+			return n, errTransportTimeout
+		}
+	}
+	return n, nil
+}
+
+func (t *simTransport) SlowInit() error {
+	time.Sleep(mutInitBreak)
+	t.sim.wake()
+	return nil
+}
+
+func (t *simTransport) Purge() error {
+	for {
+		select {
+		case <-t.replies:
+		default:
+			return nil
+		}
+	}
+}
+
+func (t *simTransport) Close() error {
+	return nil
+}
+
+func (t *simTransport) String() string {
+	return "sim"
+}
+
+// Run the simulator on a pty and open the other end as a normal serial port,
+// so the tty code path gets exercised as well
+func openSimPtyTransport(scriptPath string) (ecuTransport, error) {
+	sim, err := loadMutSimulator(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	master, slavePath, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+
+	// A break doesn't make it across a pty, so this ECU is awake from the start
+	sim.wake()
+	go func() {
+		err := serveMutSimulator(sim, master)
+		log.Printf("MUT simulator on %s stopped: %v", slavePath, err)
+	}()
+	log.Printf("MUT simulator listening on %s", slavePath)
+
+	return openSerialTransport(slavePath)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// The inverse finds the same raw value as trying every one of them would
+func TestRawInverse(t *testing.T) {
+	tests := []struct {
+		name    string
+		formula string
+		maxRaw  int
+	}{
+		{"rising", "x * 31.25", 0xFF},
+		{"offset", "(x - 128) / 5", 0xFF},
+		{"falling", "-45 * x / 255 + 140", 0xFF},
+		{"not monotonic", "(x - 100) ^ 2", 0xFF},
+		{"flat in places", "min(max(x, 50), 200)", 0xFF},
+		{"divides by zero", "1000 / x", 0xFF},
+		{"wide", "x / 1000", 0xFFFF},
+	}
+	targets := []float64{-1e9, -50, -0.1, 0, 0.1, 3, 7.5, 19.99, 60, 100.2, 140, 1000, 8000, 1e9, math.Inf(1)}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conversion, err := compileFormula(test.formula, &formulaEnv{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			inverse := newRawInverse(conversion, test.maxRaw)
+			for _, target := range targets {
+				// The nearest by brute force, the lowest raw value on a tie
+				want, wantDistance := 0, math.Inf(1)
+				for raw := 0; raw <= test.maxRaw; raw++ {
+					if distance := math.Abs(conversion(float64(raw)) - target); distance < wantDistance {
+						want, wantDistance = raw, distance
+					}
+				}
+				got := inverse.rawFor(target)
+				if got != want && math.Abs(conversion(float64(got))-target) != wantDistance {
+					t.Errorf("%v: got %d (%v), want %d (%v)", target, got, conversion(float64(got)), want, conversion(float64(want)))
+				}
+			}
+		})
+	}
+}
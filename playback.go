@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Playing a session log back on the dashboard, to watch a run again on the same gauges.
+// Unlike a replay (which goes through the raw bytes) this works from the values as
+// they were logged, and can be paused, sped up, scrubbed back and forth and stepped
+// through a frame at a time from the keyboard.
+
+// Everything that was logged at one moment
+type playbackFrame struct {
+	at     time.Duration
+	values []SensorValue
+}
+
+// Read a session log for playback, CSV or JSON going by its extension
+func loadPlaybackLog(path string) ([]playbackFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var frames []playbackFrame
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		frames, err = readCsvSessionLog(f)
+	case ".jsonl", ".json":
+		frames, err = readJsonSessionLog(f, csvLogDefaultPeriod)
+	default:
+		return nil, fmt.Errorf("%s: don't know how to play back a %q file, expected .csv or .jsonl", path, filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("%s: nothing in it to play back", path)
+	}
+	return frames, nil
+}
+
+// What the keys ask playback to do
+type playbackControl int
+
+const (
+	playbackToggle playbackControl = iota
+	playbackFaster
+	playbackSlower
+	playbackSeekBack
+	playbackSeekForward
+	playbackStepBack
+	playbackStepForward
+	playbackRestart
+)
+
+// The keys the dashboard hands on to playback
+var playbackKeys = map[string]playbackControl{
+	"<Space>": playbackToggle,
+	"+":       playbackFaster,
+	"=":       playbackFaster,
+	"-":       playbackSlower,
+	"<Left>":  playbackSeekBack,
+	"<Right>": playbackSeekForward,
+	",":       playbackStepBack,
+	".":       playbackStepForward,
+	"<Home>":  playbackRestart,
+}
+
+// How far the arrow keys jump
+const playbackSeekStep = 5 * time.Second
+
+// How slow and fast playback can go, each press of +/- doubling or halving the speed
+const (
+	playbackMinSpeed = 1.0 / 16
+	playbackMaxSpeed = 64.0
+)
+
+// Where playback has got to, for the position indicator
+type playbackStatus struct {
+	position time.Duration
+	length   time.Duration
+	frame    int
+	frames   int
+	playing  bool
+	speed    float64
+}
+
+func (s playbackStatus) String() string {
+	state := "❚❚"
+	if s.playing {
+		state = "▶"
+	}
+	return fmt.Sprintf("%s %s / %s  x%g  frame %d/%d", state, formatPlaybackTime(s.position), formatPlaybackTime(s.length), s.speed, s.frame, s.frames)
+}
+
+// How far through the log we are, as a percentage for a gauge
+func (s playbackStatus) percent() int {
+	if s.length <= 0 {
+		return 100
+	}
+	return int(100 * s.position / s.length)
+}
+
+// 83.4 seconds as "01:23.4"
+func formatPlaybackTime(d time.Duration) string {
+	minutes := int(d / time.Minute)
+	seconds := (d % time.Minute).Seconds()
+	return fmt.Sprintf("%02d:%04.1f", minutes, seconds)
+}
+
+var playbackStatusChannel = make(chan playbackStatus, 1)
+
+// Let the dashboard know where playback is. Only the latest position
+// matters, so one the dashboard hasn't picked up yet is replaced.
+func reportPlayback(status playbackStatus) {
+	select {
+	case <-playbackStatusChannel:
+	default:
+	}
+	select {
+	case playbackStatusChannel <- status:
+	default:
+	}
+}
+
+// Plays a session log back as if it were coming in live
+type playbackSource struct {
+	path   string
+	frames []playbackFrame
+
+	// From the dashboard's keys, dropped rather than holding up the UI if we're busy
+	controls chan playbackControl
+
+	// The next frame to play, and whether it's playing or paused there
+	next    int
+	playing bool
+	speed   float64
+
+	// The frame at anchorAt in the log is played at anchorWall, later frames follow on at speed
+	anchorAt   time.Duration
+	anchorWall time.Time
+}
+
+func newPlaybackSource(path string, speed float64) (*playbackSource, error) {
+	if speed < playbackMinSpeed || speed > playbackMaxSpeed {
+		return nil, fmt.Errorf("playback speed should be between %g and %g", playbackMinSpeed, playbackMaxSpeed)
+	}
+	frames, err := loadPlaybackLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &playbackSource{
+		path:     path,
+		frames:   frames,
+		controls: make(chan playbackControl, 16),
+		speed:    speed,
+	}, nil
+}
+
+func (s *playbackSource) Name() string { return "playback" }
+
+// Ask playback to do something, without ever blocking the caller
+func (s *playbackSource) control(control playbackControl) {
+	select {
+	case s.controls <- control:
+	default:
+	}
+}
+
+func (s *playbackSource) Run(ctx context.Context, out chan<- SensorValue) {
+	s.playing = true
+	s.anchor(time.Now())
+	s.report()
+
+	for {
+		// Wait for the next frame to be due, if we're playing and there is one
+		var due <-chan time.Time
+		var timer *time.Timer
+		if s.playing {
+			timer = time.NewTimer(time.Until(s.dueAt(s.frames[s.next])))
+			due = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case control := <-s.controls:
+			if timer != nil {
+				timer.Stop()
+			}
+			s.handle(control, out)
+		case <-due:
+			s.play(s.frames[s.next], out)
+			s.next++
+			if s.next == len(s.frames) {
+				// Stay on the last frame, it can be stepped or seeked back from there
+				s.playing = false
+			}
+		}
+		s.report()
+	}
+}
+
+// When a frame should be played, going by the anchor and the speed
+func (s *playbackSource) dueAt(frame playbackFrame) time.Time {
+	return s.anchorWall.Add(time.Duration(float64(frame.at-s.anchorAt) / s.speed))
+}
+
+// Carry on from the current position as of now, after a pause, seek or change of speed
+func (s *playbackSource) anchor(now time.Time) {
+	s.anchorAt, s.anchorWall = s.position(), now
+}
+
+// Where we are in the log, the time of the last frame played
+func (s *playbackSource) position() time.Duration {
+	if s.next == 0 {
+		return 0
+	}
+	return s.frames[s.next-1].at
+}
+
+func (s *playbackSource) handle(control playbackControl, out chan<- SensorValue) {
+	switch control {
+	case playbackToggle:
+		if !s.playing && s.next == len(s.frames) {
+			// Play again from the top
+			s.seek(0, out)
+		}
+		s.playing = !s.playing && s.next < len(s.frames)
+	case playbackFaster:
+		s.speed = min(s.speed*2, playbackMaxSpeed)
+	case playbackSlower:
+		s.speed = max(s.speed/2, playbackMinSpeed)
+	case playbackSeekBack:
+		s.seek(s.position()-playbackSeekStep, out)
+	case playbackSeekForward:
+		s.seek(s.position()+playbackSeekStep, out)
+	case playbackRestart:
+		s.seek(0, out)
+	case playbackStepForward:
+		s.playing = false
+		if s.next < len(s.frames) {
+			s.play(s.frames[s.next], out)
+			s.next++
+		}
+	case playbackStepBack:
+		s.playing = false
+		if s.next > 1 {
+			s.next--
+			s.restore(s.next, out)
+		}
+	}
+	s.anchor(time.Now())
+}
+
+// Jump to the last frame at or before the given time, putting every gauge back to how it was then
+func (s *playbackSource) seek(to time.Duration, out chan<- SensorValue) {
+	next := sort.Search(len(s.frames), func(i int) bool { return s.frames[i].at > to })
+	s.next = max(next, 1)
+	s.restore(s.next, out)
+	if s.next == len(s.frames) {
+		s.playing = false
+	}
+}
+
+// Send the latest value of every channel from the first n frames, which
+// (unlike a CSV row) a frame on its own may not have all of
+func (s *playbackSource) restore(n int, out chan<- SensorValue) {
+	seen := make(map[string]bool)
+	var values []SensorValue
+	for i := n - 1; i >= 0; i-- {
+		for _, value := range s.frames[i].values {
+			key := "/" + value.SensorType + "/" + value.SensorLabel
+			if !seen[key] {
+				seen[key] = true
+				values = append(values, value)
+			}
+		}
+	}
+	for _, value := range values {
+		out <- value
+	}
+}
+
+func (s *playbackSource) play(frame playbackFrame, out chan<- SensorValue) {
+	for _, value := range frame.values {
+		out <- value
+	}
+}
+
+func (s *playbackSource) report() {
+	reportPlayback(playbackStatus{
+		position: s.position(),
+		length:   s.frames[len(s.frames)-1].at,
+		frame:    s.next,
+		frames:   len(s.frames),
+		playing:  s.playing,
+		speed:    s.speed,
+	})
+}
+
+// Play a session log back on the dashboard
+func runPlay(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "how many times faster than real time to play it back")
+	profile := fs.String("profile", "", "sensor profile (JSON), or EvoScan/MitsuLogger XML as file.xml[#vehicle], for working out which source each channel in the log came from")
+	logFile := fs.String("logfile", defaultLogFile, "where to write the debug log")
+	layoutFile := fs.String("layout", "", "dashboard layout (JSON), reloaded whenever it's saved, the built-in one if empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s play [flags] session.csv|session.jsonl\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nSpace plays and pauses, +/- change the speed, the arrow keys jump 5s,\n, and . step a frame at a time and Home goes back to the start.")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one session log to play")
+	}
+
+	if err := useSensorProfile(*profile); err != nil {
+		return err
+	}
+	source, err := newPlaybackSource(fs.Arg(0), *speed)
+	if err != nil {
+		return err
+	}
+	return showDashboard([]dataSource{source}, *logFile, &dashboardConfig{Layout: *layoutFile})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The sensor tables we ship with, used when no profile is given
+//
+//go:embed profiles/default.json
+var defaultProfileJSON []byte
+
+// Sensor IDs can be written as plain numbers or as hex strings ("0x21"),
+// which is how MUT request IDs are usually quoted
+type sensorId uint16
+
+func (id *sensorId) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	value, err := strconv.ParseUint(text, 0, 16)
+	if err != nil {
+		return fmt.Errorf("bad sensor id %s", data)
+	}
+	*id = sensorId(value)
+	return nil
+}
+
+// One channel as written in a profile
+type sensorDefinition struct {
+	Id       sensorId `json:"id"`
+	Name     string   `json:"name"`
+	Unit     string   `json:"unit"`
+	Priority string   `json:"priority,omitempty"`
+	Rate     float64  `json:"rate,omitempty"`
+	Formula  string   `json:"formula"`
+	Min      float64  `json:"min"`
+	Max      float64  `json:"max"`
+	Decimals int      `json:"decimals"`
+
+	// For 16-bit MUT sensors, the request that returns the low byte
+	LowId *sensorId `json:"lowId,omitempty"`
+}
+
+// A complete set of sensor definitions for a car
+type sensorProfile struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Mut         []sensorDefinition `json:"mut"`
+	Imfd        []sensorDefinition `json:"imfd"`
+
+	// Channels worked out from the others rather than read from a sensor, see computedChannel
+	Computed []sensorDefinition `json:"computed,omitempty"`
+
+	// Which ECUs this profile is for, when picking one automatically
+	Match *profileMatch `json:"match,omitempty"`
+
+	// Lookup tables the formulas can interpolate through with lookup(name, value)
+	Tables map[string]lookupTable `json:"tables,omitempty"`
+}
+
+// The sensor tables built from a profile, ready to be swapped in
+type sensorTables struct {
+	mut      map[uint16]mutSensor
+	wide     map[uint16]byte
+	imfd     map[int]imfdSensor
+	computed []computedChannel
+	profile  *sensorProfile
+}
+
+var validPriorities = map[string]bool{"high": true, "medium": true, "low": true, "none": true}
+
+// Read a profile from disk, or the built-in one if the path is empty.
+// EvoScan and MitsuLogger XML files are imported on the fly.
+func readSensorProfile(path string) (*sensorProfile, error) {
+	if file, _, _ := strings.Cut(path, "#"); strings.HasSuffix(strings.ToLower(file), ".xml") {
+		return readLoggerProfile(path)
+	}
+
+	data := defaultProfileJSON
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseSensorProfile(data, profileSource(path))
+}
+
+func parseSensorProfile(data []byte, source string) (*sensorProfile, error) {
+	var profile sensorProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("profile %s: %w", source, err)
+	}
+	return &profile, nil
+}
+
+func profileSource(path string) string {
+	if path == "" {
+		return "(built-in)"
+	}
+	return path
+}
+
+// Check every definition and compile the formulas, collecting all the
+// problems rather than stopping at the first so they can be fixed in one go
+func (p *sensorProfile) compile() (*sensorTables, error) {
+	tables := &sensorTables{
+		mut:     make(map[uint16]mutSensor),
+		wide:    make(map[uint16]byte),
+		imfd:    make(map[int]imfdSensor),
+		profile: p,
+	}
+	var problems []error
+
+	// Formulas can use the profile's tables and refer to any channel in it
+	for name, table := range p.Tables {
+		if err := table.check(); err != nil {
+			problems = append(problems, fmt.Errorf("table %q: %w", name, err))
+		}
+	}
+	channels := map[string]map[string]bool{"mut": {}, "imfd": {}}
+	for _, definition := range p.Mut {
+		channels["mut"][definition.Name] = true
+	}
+	for _, definition := range p.Imfd {
+		channels["imfd"][definition.Name] = true
+	}
+	mutEnv := &formulaEnv{source: "mut", channels: channels, tables: p.Tables}
+	imfdEnv := &formulaEnv{source: "imfd", channels: channels, tables: p.Tables}
+
+	// Computed channels can only refer to the ones before them, so they can't go round in circles
+	computedEnv := &formulaEnv{
+		source:   computedSource,
+		channels: map[string]map[string]bool{"mut": channels["mut"], "imfd": channels["imfd"], computedSource: {}},
+		tables:   p.Tables,
+	}
+
+	// Channels are known by their source and name, so two sensors with the same name
+	// would have their values mixed up everywhere from the gauges to the logs
+	named := map[string]map[string]bool{"mut": {}, "imfd": {}}
+
+	for i, definition := range p.Mut {
+		where := fmt.Sprintf("mut[%d] %q", i, definition.Name)
+		conversionFunction, errs := definition.check(mutEnv)
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+		}
+		if definition.Id > 0xFF {
+			problems = append(problems, fmt.Errorf("%s: request id 0x%X doesn't fit in a byte", where, uint16(definition.Id)))
+		}
+		if !validPriorities[definition.Priority] {
+			problems = append(problems, fmt.Errorf("%s: priority %q should be high, medium, low or none", where, definition.Priority))
+		}
+
+		// Sensors are polled at the rate for their priority unless they ask for their own
+		rate := definition.Rate
+		switch {
+		case rate < 0 || rate > mutMaxRate:
+			problems = append(problems, fmt.Errorf("%s: rate (%g Hz) should be between 0 and %d Hz", where, rate, mutMaxRate))
+		case rate > 0 && definition.Priority == "none":
+			problems = append(problems, fmt.Errorf("%s: has a rate but priority none, so it won't be polled", where))
+		case rate == 0:
+			rate = mutPriorityRates[definition.Priority]
+		}
+		if _, exists := tables.mut[uint16(definition.Id)]; exists {
+			problems = append(problems, fmt.Errorf("%s: duplicate id 0x%02X", where, uint16(definition.Id)))
+		}
+		if definition.Name != "" && named["mut"][definition.Name] {
+			problems = append(problems, fmt.Errorf("%s: duplicate name", where))
+		}
+		named["mut"][definition.Name] = true
+		if definition.LowId != nil {
+			if *definition.LowId > 0xFF {
+				problems = append(problems, fmt.Errorf("%s: low byte request id 0x%X doesn't fit in a byte", where, uint16(*definition.LowId)))
+			}
+			tables.wide[uint16(definition.Id)] = byte(*definition.LowId)
+		}
+
+		tables.mut[uint16(definition.Id)] = mutSensor{
+			name:               definition.Name,
+			unit:               definition.Unit,
+			conversionFunction: conversionFunction,
+			priority:           definition.Priority,
+			rate:               rate,
+			min:                definition.Min,
+			max:                definition.Max,
+			decimals:           definition.Decimals,
+		}
+	}
+
+	for i, definition := range p.Imfd {
+		where := fmt.Sprintf("imfd[%d] %q", i, definition.Name)
+		conversionFunction, errs := definition.check(imfdEnv)
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+		}
+		if definition.Priority != "" {
+			problems = append(problems, fmt.Errorf("%s: iMFD sensors are pushed to us, they can't have a priority", where))
+		}
+		if definition.Rate != 0 {
+			problems = append(problems, fmt.Errorf("%s: iMFD sensors are pushed to us, they can't have a rate", where))
+		}
+		if definition.LowId != nil {
+			problems = append(problems, fmt.Errorf("%s: iMFD sensors can't have a low byte request", where))
+		}
+		if _, exists := tables.imfd[int(definition.Id)]; exists {
+			problems = append(problems, fmt.Errorf("%s: duplicate id %d", where, definition.Id))
+		}
+		if definition.Name != "" && named["imfd"][definition.Name] {
+			problems = append(problems, fmt.Errorf("%s: duplicate name", where))
+		}
+		named["imfd"][definition.Name] = true
+
+		tables.imfd[int(definition.Id)] = imfdSensor{
+			name:               definition.Name,
+			unit:               definition.Unit,
+			conversionFunction: conversionFunction,
+			min:                definition.Min,
+			max:                definition.Max,
+			decimals:           definition.Decimals,
+		}
+	}
+
+	for i, definition := range p.Computed {
+		where := fmt.Sprintf("computed[%d] %q", i, definition.Name)
+		for _, err := range definition.checkLimits() {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+		}
+		formula, inputs, err := compileComputedFormula(definition.Formula, computedEnv)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", where, err))
+		}
+		if definition.Id != 0 || definition.LowId != nil {
+			problems = append(problems, fmt.Errorf("%s: computed channels aren't requested, they can't have an id", where))
+		}
+		if definition.Priority != "" || definition.Rate != 0 {
+			problems = append(problems, fmt.Errorf("%s: computed channels go at the rate of their inputs, they can't have a priority or rate", where))
+		}
+		if computedEnv.channels[computedSource][definition.Name] {
+			problems = append(problems, fmt.Errorf("%s: duplicate name", where))
+		}
+		computedEnv.channels[computedSource][definition.Name] = true
+
+		tables.computed = append(tables.computed, computedChannel{
+			name:     definition.Name,
+			unit:     definition.Unit,
+			formula:  formula,
+			inputs:   inputs,
+			min:      definition.Min,
+			max:      definition.Max,
+			decimals: definition.Decimals,
+		})
+	}
+
+	if p.Match != nil {
+		problems = append(problems, p.Match.check()...)
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("profile %q is invalid:\n%w", p.Name, errors.Join(problems...))
+	}
+	return tables, nil
+}
+
+// The checks that apply to every definition, returning the compiled formula
+func (d sensorDefinition) check(env *formulaEnv) (func(float64) float64, []error) {
+	problems := d.checkLimits()
+	conversionFunction, err := compileFormula(d.Formula, env)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	return conversionFunction, problems
+}
+
+// The most decimals a value can be shown with
+const profileMaxDecimals = 6
+
+// The checks that apply to every definition, other than its formula
+func (d sensorDefinition) checkLimits() []error {
+	var problems []error
+	if d.Name == "" {
+		problems = append(problems, errors.New("missing name"))
+	}
+	if d.Min >= d.Max {
+		problems = append(problems, fmt.Errorf("min (%g) should be less than max (%g)", d.Min, d.Max))
+	}
+	if d.Decimals < 0 || d.Decimals > profileMaxDecimals {
+		problems = append(problems, fmt.Errorf("decimals (%d) should be between 0 and %d", d.Decimals, profileMaxDecimals))
+	}
+	return problems
+}
+
+// The sensor tables can be swapped once the ECU has identified itself,
+// so anything that reads them off the MUT session's goroutine needs this
+var sensorTablesMu sync.RWMutex
+
+// Swap the sensor tables in for the rest of the dashboard to use
+func (t *sensorTables) apply() {
+	sensorTablesMu.Lock()
+	defer sensorTablesMu.Unlock()
+	mutSensors = t.mut
+	mutWideSensors = t.wide
+	imfdSensors = t.imfd
+	computedChannels = t.computed
+	activeProfile = t.profile
+}
+
+// The profile the sensor tables were last built from
+var activeProfile *sensorProfile
+
+// Load, check and apply a sensor profile. With no path the built-in profiles are
+// loaded instead, starting off with the full one until the ECU tells us what it is.
+func useSensorProfile(path string) error {
+	if path == "" {
+		registry, err := loadProfileRegistry()
+		if err != nil {
+			return err
+		}
+		profileRegistry = registry
+		registry.fallback.apply()
+		return nil
+	}
+
+	profile, err := readSensorProfile(path)
+	if err != nil {
+		return err
+	}
+	tables, err := profile.compile()
+	if err != nil {
+		return err
+	}
+	tables.apply()
+	return nil
+}
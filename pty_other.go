@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Simulators on a pty are only supported on Linux
+func openPty() (*os.File, string, error) {
+	return nil, "", errors.New("pty simulators are only supported on linux")
+}
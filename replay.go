@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replay plays a capture back through the same decoders the live sources use,
+// so a drive that showed up a decoding bug can be gone over again (and again)
+// on the dashboard, at the speed it happened or faster.
+//
+// The MUT side doesn't answer whatever the scheduler asks for, which would depend
+// on what's on screen this time around. Instead it goes through the exchanges in
+// the order they were captured, with a replayTransport handing back what the ECU
+// said, so mutSerialInit, the codec and mutReader make of it just what they did at the time.
+
+var (
+	errReplayDiverged = errors.New("replay: doesn't match the capture")
+	errReplayFinished = errors.New("replay: end of capture")
+)
+
+type replaySource struct {
+	path   string
+	events []captureEvent
+
+	// How much faster than real time to go, 0 for as fast as we can
+	speed float64
+}
+
+// The spec is the capture's path, optionally followed by the speed:
+// "drive.cap@4" for four times faster, "drive.cap@0" for as fast as possible
+func newReplaySource(spec string) (dataSource, error) {
+	path, speed := spec, 1.0
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		if s, err := strconv.ParseFloat(spec[i+1:], 64); err == nil {
+			path, speed = spec[:i], s
+		}
+	}
+	return loadReplaySource(path, speed)
+}
+
+func loadReplaySource(path string, speed float64) (*replaySource, error) {
+	if speed < 0 {
+		return nil, fmt.Errorf("replay speed can't be negative")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events, err := readCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &replaySource{path: path, events: events, speed: speed}, nil
+}
+
+func (s *replaySource) Name() string { return "replay" }
+
+// Play the whole capture back, each source's events alongside the others as they happened
+func (s *replaySource) Run(ctx context.Context, out chan<- SensorValue) {
+	clock := replayClock{started: time.Now(), speed: s.speed}
+
+	bySource := make(map[string][]captureEvent)
+	for _, event := range s.events {
+		bySource[event.source] = append(bySource[event.source], event)
+	}
+
+	var wg sync.WaitGroup
+	for source, events := range bySource {
+		var replay func(context.Context, replayClock, []captureEvent, chan<- SensorValue)
+		switch source {
+		case "mut":
+			replay = replayMut
+		case "imfd":
+			replay = replayImfd
+		default:
+			log.Printf("Skipping %d events from unknown source %q in %s", len(events), source, s.path)
+			continue
+		}
+		wg.Add(1)
+		go func(events []captureEvent) {
+			defer wg.Done()
+			replay(ctx, clock, events, out)
+		}(events)
+	}
+	wg.Wait()
+	log.Printf("Finished replaying %s", s.path)
+}
+
+// Keeps the replay in step with the capture's timestamps
+type replayClock struct {
+	started time.Time
+	speed   float64
+}
+
+// Wait for the moment something happened in the capture, returning false if ctx is cancelled first
+func (c replayClock) waitFor(ctx context.Context, at time.Duration) bool {
+	if c.speed == 0 {
+		return ctx.Err() == nil
+	}
+	return sleepContext(ctx, time.Until(c.started.Add(time.Duration(float64(at)/c.speed))))
+}
+
+// Hands back the ECU's side of the captured exchanges, one at a time
+type replayTransport struct {
+	ctx    context.Context
+	clock  replayClock
+	events []captureEvent
+	next   int
+
+	// The transport the capture was made on
+	name string
+}
+
+func (t *replayTransport) peek() (captureEvent, bool) {
+	if t.next >= len(t.events) {
+		return captureEvent{}, false
+	}
+	return t.events[t.next], true
+}
+
+// Move on past the next event without acting on it
+func (t *replayTransport) skip() {
+	t.next++
+}
+
+// Take the next event, which has to be of the given kind, once it's time for it
+func (t *replayTransport) take(kind string) (captureEvent, error) {
+	event, ok := t.peek()
+	if !ok {
+		return event, errReplayFinished
+	}
+	if event.kind != kind {
+		return event, fmt.Errorf("%w: expected %s, the capture has %q", errReplayDiverged, kind, event)
+	}
+	t.next++
+	if !t.clock.waitFor(t.ctx, event.at) {
+		return event, t.ctx.Err()
+	}
+	return event, nil
+}
+
+func (t *replayTransport) WriteRequest(data []byte) error {
+	event, err := t.take(captureWrite)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(event.data, data) {
+		return fmt.Errorf("%w: sent % X, the capture has % X", errReplayDiverged, data, event.data)
+	}
+	return nil
+}
+
+func (t *replayTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	event, err := t.take(captureRead)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(buf, event.data)
+	return n, replayError(event.note)
+}
+
+func (t *replayTransport) SlowInit() error {
+	_, err := t.take(captureInit)
+	return err
+}
+
+func (t *replayTransport) Purge() error {
+	_, err := t.take(capturePurge)
+	return err
+}
+
+func (t *replayTransport) Close() error {
+	return nil
+}
+
+func (t *replayTransport) String() string {
+	return "replay of " + t.name
+}
+
+// The error a captured read ended with, going by its note
+func replayError(note string) error {
+	switch {
+	case note == "timeout":
+		return errTransportTimeout
+	case note == "error: "+errImfdSilent.Error():
+		return errImfdSilent
+	case strings.HasPrefix(note, "error: "):
+		return errors.New(strings.TrimPrefix(note, "error: "))
+	}
+	return nil
+}
+
+// Go through the MUT side of a capture, session by session, passing
+// whatever the ECU answered through mutReader as it was at the time
+func replayMut(ctx context.Context, clock replayClock, events []captureEvent, out chan<- SensorValue) {
+	responses := make(chan mutResponse)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		mutReader(ctx, responses, out)
+	}()
+	defer func() {
+		close(responses)
+		<-readerDone
+	}()
+
+	transport := &replayTransport{ctx: ctx, clock: clock, events: events}
+	var codec mutCodec
+	var health *mutLinkHealth
+	for ctx.Err() == nil {
+		event, ok := transport.peek()
+		if !ok {
+			reportLinkStatus(linkStatus{"mut", linkDown, "end of capture"})
+			return
+		}
+
+		switch {
+		case event.kind == captureOpen:
+			// A new session, which starts by waking the ECU up
+			transport.take(captureOpen)
+			transport.name = event.note
+			reportLinkStatus(linkStatus{"mut", linkConnecting, transport.String()})
+
+			var identity ecuIdentity
+			var err error
+			codec, identity, err = mutSerialInit(transport)
+			if err != nil {
+				health = nil
+				reportLinkStatus(linkStatus{"mut", linkDown, err.Error()})
+				continue
+			}
+			selectEcuProfile(identity)
+			reportLinkStatus(linkStatus{"mut", linkUp, transport.String()})
+			health = &mutLinkHealth{transport: transport}
+		case event.kind == captureWrite && health != nil && len(event.data) > 0:
+			err := replayMutRequest(ctx, transport, codec, responses, event.data[0])
+			if errors.Is(err, errReplayDiverged) {
+				// Most likely the profile doesn't agree with the one the capture was made with
+				log.Printf("[Replay] %v", err)
+				continue
+			}
+			if err := health.record(err); err != nil {
+				health = nil
+				reportLinkStatus(linkStatus{"mut", linkDown, err.Error()})
+			}
+		default:
+			// The end of a session, or the rest of one we couldn't make sense of
+			transport.skip()
+		}
+	}
+	reportLinkStatus(linkStatus{"mut", linkDown, "stopped"})
+}
+
+// Replay a single sensor read, starting with the given request byte.
+// Requests the profile doesn't know about (from a scan, say) are only logged.
+func replayMutRequest(ctx context.Context, transport ecuTransport, codec mutCodec, responses chan<- mutResponse, request byte) error {
+	sensorId := uint16(request)
+	sensorTablesMu.RLock()
+	_, known := mutSensors[sensorId]
+	sensorTablesMu.RUnlock()
+
+	if !known {
+		b, err := mutExchange(transport, codec, request)
+		if err == nil {
+			log.Printf("[Replay] Request 0x%02X isn't in the profile, the ECU answered %d", request, b)
+		}
+		return err
+	}
+
+	value, err := mutReadSensor(transport, codec, sensorId)
+	if err != nil {
+		return err
+	}
+	select {
+	case responses <- mutResponse{sensorId, value}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// Go through the iMFD side of a capture, feeding each session's frames
+// through the frame parser and on to imfdSensorDecode
+func replayImfd(ctx context.Context, clock replayClock, events []captureEvent, out chan<- SensorValue) {
+	for i := 0; i < len(events) && ctx.Err() == nil; i++ {
+		if events[i].kind != captureOpen {
+			continue
+		}
+		if !clock.waitFor(ctx, events[i].at) {
+			break
+		}
+		portName := "replay of " + events[i].note
+		reportLinkStatus(linkStatus{"imfd", linkConnecting, portName})
+
+		// Everything read from the port until it was closed again
+		end := i + 1
+		for end < len(events) && events[end].kind == captureFrame {
+			end++
+		}
+		reader := &imfdReplayReader{ctx: ctx, clock: clock, frames: events[i+1 : end]}
+		parser := newImfdFrameParser(reader, nil)
+
+		_, err := imfdReadFrames(ctx, parser, portName, out)
+		reportImfdStats(parser.stats)
+		if err == io.EOF {
+			err = errors.New("closed")
+		}
+		reportLinkStatus(linkStatus{"imfd", linkDown, err.Error()})
+		i = end - 1
+	}
+	if ctx.Err() != nil {
+		reportLinkStatus(linkStatus{"imfd", linkDown, "stopped"})
+		return
+	}
+	reportLinkStatus(linkStatus{"imfd", linkDown, "end of capture"})
+}
+
+// Reads back the raw bytes of the captured frames, each when it arrived,
+// failing the same way the port did. Runs out at the end of the session.
+type imfdReplayReader struct {
+	ctx    context.Context
+	clock  replayClock
+	frames []captureEvent
+
+	pending    []byte
+	pendingErr error
+}
+
+func (r *imfdReplayReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.pendingErr != nil {
+			err := r.pendingErr
+			r.pendingErr = nil
+			return 0, err
+		}
+		if len(r.frames) == 0 {
+			return 0, io.EOF
+		}
+		frame := r.frames[0]
+		r.frames = r.frames[1:]
+		if !r.clock.waitFor(r.ctx, frame.at) {
+			return 0, r.ctx.Err()
+		}
+		r.pending, r.pendingErr = frame.data, replayError(frame.note)
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Play a capture back on the dashboard
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "how many times faster than real time to play it back, 0 for as fast as possible")
+	profile := fs.String("profile", "", "sensor profile (JSON), or EvoScan/MitsuLogger XML as file.xml[#vehicle], picked from the ECU ID if empty")
+	logFile := fs.String("logfile", defaultLogFile, "where to write the debug log")
+	layoutFile := fs.String("layout", "", "dashboard layout (JSON), reloaded whenever it's saved, the built-in one if empty")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] capture\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one capture to replay")
+	}
+
+	if err := useSensorProfile(*profile); err != nil {
+		return err
+	}
+	source, err := loadReplaySource(fs.Arg(0), *speed)
+	if err != nil {
+		return err
+	}
+	return showDashboard([]dataSource{source}, *logFile, &dashboardConfig{Layout: *layoutFile})
+}
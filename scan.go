@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// The highest request the scan will send unless told it's safe to go further.
+// Above this are commands rather than reads (actuator tests, clearing trouble
+// codes...) which have no business being fired off at a running engine.
+const mutScanSafeLimit = 0xBF
+
+// Ask the ECU for every request ID in a range and report which ones it answers,
+// along with what the profile makes of the answer
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	flags := addSourceFlags(fs, false)
+	from := fs.String("from", "0x00", "first request ID to try")
+	to := fs.String("to", fmt.Sprintf("0x%02X", mutScanSafeLimit), "last request ID to try")
+	unsafe := fs.Bool("unsafe", false, fmt.Sprintf("allow request IDs above 0x%02X, which can trigger actuator tests", mutScanSafeLimit))
+	logFile := fs.String("logfile", defaultLogFile, "where to write the debug log")
+	fs.Parse(args)
+
+	first, err := strconv.ParseUint(*from, 0, 8)
+	if err != nil {
+		return fmt.Errorf("bad -from: %w", err)
+	}
+	last, err := strconv.ParseUint(*to, 0, 8)
+	if err != nil {
+		return fmt.Errorf("bad -to: %w", err)
+	}
+	if last > mutScanSafeLimit && !*unsafe {
+		return fmt.Errorf("requests above 0x%02X can trigger actuator tests, use -unsafe if you really mean it", mutScanSafeLimit)
+	}
+
+	config, err := flags.load()
+	if err != nil {
+		return err
+	}
+	closeLog, err := openDebugLog(*logFile)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	stopCapture, err := flags.startCapture()
+	if err != nil {
+		return err
+	}
+	defer stopCapture()
+
+	if err := useSensorProfile(config.Profile); err != nil {
+		return err
+	}
+	transportSpec := config.Sources["mut"]
+	if sourceDisabled(transportSpec) {
+		return fmt.Errorf("no MUT transport to scan")
+	}
+
+	transport, err := openTransport(transportSpec)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+
+	codec, identity, err := mutSerialInit(transport)
+	if err != nil {
+		return err
+	}
+	selectEcuProfile(identity)
+	fmt.Printf("%s on %s (echo: %t), profile %q\n\n", identity, transport, codec.echo, activeProfile.Name)
+
+	// Work out which requests are halves of the 16-bit sensors, their bytes mean nothing on their own
+	lowBytes := make(map[byte]uint16)
+	for sensorId, lowByte := range mutWideSensors {
+		lowBytes[lowByte] = sensorId
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	answered, unknown := 0, 0
+	for id := first; id <= last; id++ {
+		request := byte(id)
+		b, err := mutExchange(transport, codec, request)
+		if err != nil {
+			if classifyMutError(err) == mutFaultUnplugged {
+				w.Flush()
+				return err
+			}
+			// No answer, throw away anything half received before the next request
+			if err := transport.Purge(); err != nil {
+				w.Flush()
+				return err
+			}
+			continue
+		}
+		answered++
+
+		sensor, known := mutSensors[uint16(request)]
+		_, wide := mutWideSensors[uint16(request)]
+		wideSensorId, lowHalf := lowBytes[request]
+		switch {
+		case known && wide:
+			fmt.Fprintf(w, "0x%02X\t%3d\t%s (high byte)\n", request, b, sensor.name)
+		case known:
+			value := sensor.conversionFunction(float64(b))
+			fmt.Fprintf(w, "0x%02X\t%3d\t%s = %.*f %s\n", request, b, sensor.name, sensor.decimals, value, sensor.unit)
+		case lowHalf:
+			fmt.Fprintf(w, "0x%02X\t%3d\t%s (low byte)\n", request, b, mutSensors[wideSensorId].name)
+		default:
+			unknown++
+			fmt.Fprintf(w, "0x%02X\t%3d\tnot in the profile\n", request, b)
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d of %d requests answered, %d of them not in the profile\n", answered, last-first+1, unknown)
+	return nil
+}
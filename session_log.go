@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Somewhere the samples from a logging session end up
+type sampleLog interface {
+	// Take a sample as it arrives
+	record(at time.Time, value SensorValue) error
+
+	// Called every tickInterval, to write out what has come in since
+	tick(at time.Time) error
+	tickInterval() time.Duration
+
+	// The profile has changed, these are the channels to expect from now on
+	setChannels(channels []channelInfo) error
+
+	// Mark something that happened (an alarm going off) alongside the samples
+	note(at time.Time, text string) error
+
+	close() error
+
+	// What was written where, for when the session is over
+	String() string
+}
+
+// The formats a session can be logged in
+var sampleLogFormats = map[string]func(dir string, started time.Time, period time.Duration) (sampleLog, error){
+	"csv":   createCsvSessionLog,
+	"jsonl": createJsonSessionLog,
+}
+
+// How often buffered samples are pushed out to the file, so pulling the
+// power on a logging session loses no more than this much of it
+const sessionFlushInterval = time.Second
+
+// One sample as it's written to a session log, a line of JSON each:
+//
+//	{"time":"2024-05-04T10:15:02.123+10:00","type":"mut-sensor","label":"Engine RPM","value":3250,"unit":"rpm"}
+//
+// A value that isn't a number (a formula dividing by zero, or waiting on a channel
+// it refers to) is written as null, JSON having no way to write NaN or infinity.
+//
+// Notes go in between, with just the time and the note:
+//
+//	{"time":"2024-05-04T10:15:02.180+10:00","note":"Coolant Temp critical: 106 C, over 105"}
+type loggedSample struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Label    string    `json:"label"`
+	Instance int       `json:"instance,omitempty"`
+	Value    *float64  `json:"value"`
+	Unit     string    `json:"unit,omitempty"`
+
+	// Only set on a note, when reading them back
+	Note string `json:"note,omitempty"`
+}
+
+type loggedNote struct {
+	Time time.Time `json:"time"`
+	Note string    `json:"note"`
+}
+
+// Every sample from a logging session, in the order they arrived,
+// for when the exact timing matters more than opening it in a log viewer
+type jsonSessionLog struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	samples uint64
+}
+
+// Start a new session log in dir, named for when it started. Every sample
+// is written as it comes in, so there's no period to worry about.
+func createJsonSessionLog(dir string, started time.Time, period time.Duration) (sampleLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "session-"+started.Format("20060102-150405")+".jsonl")
+
+	// Never write over an earlier session
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &jsonSessionLog{path: path, file: f, writer: w, encoder: json.NewEncoder(w)}, nil
+}
+
+func (l *jsonSessionLog) record(at time.Time, value SensorValue) error {
+	l.samples++
+	sample := loggedSample{
+		Time:     at,
+		Type:     value.SensorType,
+		Label:    value.SensorLabel,
+		Instance: value.SensorInstance,
+		Unit:     value.SensorUnit,
+	}
+	if !math.IsNaN(value.SensorValue) && !math.IsInf(value.SensorValue, 0) {
+		sample.Value = &value.SensorValue
+	}
+	return l.encoder.Encode(sample)
+}
+
+func (l *jsonSessionLog) note(at time.Time, text string) error {
+	return l.encoder.Encode(loggedNote{at, text})
+}
+
+func (l *jsonSessionLog) tick(at time.Time) error {
+	return l.flush()
+}
+
+func (l *jsonSessionLog) tickInterval() time.Duration {
+	return sessionFlushInterval
+}
+
+// Every sample is written with its name, so a new profile changes nothing
+func (l *jsonSessionLog) setChannels(channels []channelInfo) error {
+	return nil
+}
+
+func (l *jsonSessionLog) String() string {
+	return fmt.Sprintf("%d samples to %s", l.samples, l.path)
+}
+
+func (l *jsonSessionLog) flush() error {
+	if err := l.writer.Flush(); err != nil {
+		return fmt.Errorf("session log %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Flush everything out to the disk and close the file
+func (l *jsonSessionLog) close() error {
+	err := l.flush()
+	if syncErr := l.file.Sync(); syncErr != nil {
+		err = errors.Join(err, fmt.Errorf("session log %s: %w", l.path, syncErr))
+	}
+	return errors.Join(err, l.file.Close())
+}
+
+// Read a JSON session log back in for playback, gathering the samples into
+// frames a period long so stepping through it doesn't go one sample at a time
+func readJsonSessionLog(r io.Reader, period time.Duration) ([]playbackFrame, error) {
+	decoder := json.NewDecoder(r)
+	var frames []playbackFrame
+	var started time.Time
+	for n := 1; ; n++ {
+		var sample loggedSample
+		err := decoder.Decode(&sample)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sample %d: %w", n, err)
+		}
+
+		if sample.Note != "" || sample.Value == nil {
+			// Not a sample, or one with no number to show, there's nothing to play back
+			continue
+		}
+		if len(frames) == 0 {
+			started = sample.Time
+		}
+		at := sample.Time.Sub(started)
+		if len(frames) > 0 && at < frames[len(frames)-1].at {
+			return nil, fmt.Errorf("sample %d: time goes backwards", n)
+		}
+		if len(frames) == 0 || at-frames[len(frames)-1].at >= period {
+			frames = append(frames, playbackFrame{at: at})
+		}
+		frame := &frames[len(frames)-1]
+		frame.values = append(frame.values, SensorValue{sample.Label, sample.Type, sample.Instance, *sample.Value, sample.Unit})
+	}
+	return frames, nil
+}
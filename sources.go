@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Somewhere sensor values come from: the ECU, the Defi gauges, a log being played back...
+type dataSource interface {
+	// The name the source's channels are published under ("mut", "imfd")
+	Name() string
+
+	// Stream values to out until ctx is cancelled, riding out (and reporting)
+	// any trouble with the link along the way
+	Run(ctx context.Context, out chan<- SensorValue)
+}
+
+// How to make each kind of source from its spec (a transport, a port...)
+var sourceFactories = map[string]func(spec string) (dataSource, error){
+	"mut":    newMutSource,
+	"imfd":   newImfdSource,
+	"replay": newReplaySource,
+}
+
+// Whether a source spec means the source shouldn't run at all
+func sourceDisabled(spec string) bool {
+	return spec == "" || strings.EqualFold(spec, "off")
+}
+
+func newDataSource(name string, spec string) (dataSource, error) {
+	factory, ok := sourceFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q", name)
+	}
+	source, err := factory(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s source: %w", name, err)
+	}
+	return source, nil
+}
+
+// Runs the data sources, each in its own goroutine, and merges everything
+// they produce into one stream of values
+type sourceManager struct {
+	mu      sync.Mutex
+	running map[string]*runningSource
+
+	// Every source sends here, merge passes it on
+	values chan SensorValue
+}
+
+type runningSource struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newSourceManager() *sourceManager {
+	return &sourceManager{
+		running: make(map[string]*runningSource),
+		values:  make(chan SensorValue),
+	}
+}
+
+// Start a source, replacing any source already running under the same name
+func (m *sourceManager) start(source dataSource) {
+	m.stop(source.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &runningSource{cancel: cancel, done: make(chan struct{})}
+
+	m.mu.Lock()
+	m.running[source.Name()] = running
+	m.mu.Unlock()
+
+	log.Printf("Starting %s source", source.Name())
+	go func() {
+		defer close(running.done)
+		source.Run(ctx, m.values)
+		log.Printf("%s source stopped", source.Name())
+	}()
+}
+
+// Stop a source and wait for it to finish. Whatever reads the merged
+// stream has to keep going until this returns, the source may be part way
+// through handing over a value.
+func (m *sourceManager) stop(name string) {
+	m.mu.Lock()
+	running, ok := m.running[name]
+	delete(m.running, name)
+	m.mu.Unlock()
+
+	if ok {
+		running.cancel()
+		<-running.done
+	}
+}
+
+func (m *sourceManager) stopAll() {
+	for _, name := range m.names() {
+		m.stop(name)
+	}
+}
+
+// Stop every source and shut the merged stream, merge returns
+// once it has passed on the last value they sent
+func (m *sourceManager) close() {
+	m.stopAll()
+	close(m.values)
+}
+
+// Wait for every running source to finish by itself, which
+// only the ones that run out (like a replay) ever do
+func (m *sourceManager) wait() {
+	m.mu.Lock()
+	running := make([]*runningSource, 0, len(m.running))
+	for _, source := range m.running {
+		running = append(running, source)
+	}
+	m.mu.Unlock()
+
+	for _, source := range running {
+		<-source.done
+	}
+}
+
+// The names of the running sources
+func (m *sourceManager) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.running))
+	for name := range m.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pass every value from every source on to out, remembering the latest of each for
+// any formulas that refer to them, followed by the computed channels that use it
+func (m *sourceManager) merge(out chan<- SensorValue) {
+	for value := range m.values {
+		if value.SensorType == computedSource && isComputedChannel("/"+value.SensorType+"/"+value.SensorLabel) {
+			// A log being played back has them too, but we'd rather go by our own formulas
+			continue
+		}
+		latestValues.record(value)
+		computed := computeChannels(value)
+		out <- value
+		for _, value := range computed {
+			out <- value
+		}
+	}
+}
+
+// Start every enabled source in the config, in a stable order
+func (m *sourceManager) startAll(sources []dataSource) {
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name() < sources[j].Name() })
+	for _, source := range sources {
+		m.start(source)
+	}
+}
+
+// Build the sources the config asks for, so any problems with
+// them turn up before anything starts running
+func configuredSources(config *dashboardConfig) ([]dataSource, error) {
+	var sources []dataSource
+	for name, spec := range config.Sources {
+		if sourceDisabled(spec) {
+			continue
+		}
+		source, err := newDataSource(name, spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// The ECU, over whatever transport the spec names
+type mutSource struct {
+	transportSpec string
+}
+
+func newMutSource(spec string) (dataSource, error) {
+	return &mutSource{transportSpec: spec}, nil
+}
+
+func (s *mutSource) Name() string { return "mut" }
+
+func (s *mutSource) Run(ctx context.Context, out chan<- SensorValue) {
+	// The stream asks, the reader decodes what comes back
+	responses := make(chan mutResponse)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		mutReader(ctx, responses, out)
+	}()
+
+	mutStream(ctx, s.transportSpec, responses)
+
+	close(responses)
+	<-readerDone
+}
+
+// The Defi gauges, on a serial port or the built-in simulator
+type imfdSource struct {
+	portName string
+}
+
+func newImfdSource(spec string) (dataSource, error) {
+	// Swap in the built-in simulator if asked, it hands back the pty to read from
+	portName := spec
+	if kind, script, _ := strings.Cut(spec, ":"); kind == "sim" {
+		var err error
+		if portName, err = startImfdSimulatorPty(script); err != nil {
+			return nil, err
+		}
+	}
+	return &imfdSource{portName: portName}, nil
+}
+
+func (s *imfdSource) Name() string { return "imfd" }
+
+func (s *imfdSource) Run(ctx context.Context, out chan<- SensorValue) {
+	imfdStream(ctx, s.portName, out)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Statistics for every channel since they were last reset (with the r key, between
+// pulls say), so the highest boost or the leanest AFR of a run is there afterwards
+// without having to stare at the gauge for it. They're kept along with the channel's
+// history, whose latest values give the average of the last few.
+
+// How many values an average goes back over unless the layout says otherwise
+const statsDefaultSamples = 10
+
+// The statistics a stat widget can show, with what goes after the channel's name in its title
+var statNames = map[string]string{
+	"min":     "min",
+	"max":     "max",
+	"mean":    "mean",
+	"average": "avg",
+	"above":   "over",
+}
+
+type channelStats struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	last  timedSample
+
+	// How long the channel's spent above each threshold someone's asked about. A value
+	// counts until the next one comes in, so a link going down doesn't run the clock.
+	above map[float64]time.Duration
+}
+
+func newChannelStats() *channelStats {
+	return &channelStats{above: make(map[float64]time.Duration)}
+}
+
+func (s *channelStats) add(sample timedSample) {
+	// One NaN would make the mean NaN for good, and an infinity the min or max
+	if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+		return
+	}
+	if s.count > 0 {
+		for threshold := range s.above {
+			if s.last.value > threshold {
+				s.above[threshold] += sample.at.Sub(s.last.at)
+			}
+		}
+	}
+	if s.count == 0 || sample.value < s.min {
+		s.min = sample.value
+	}
+	if s.count == 0 || sample.value > s.max {
+		s.max = sample.value
+	}
+	s.count++
+	s.sum += sample.value
+	s.last = sample
+}
+
+func (s *channelStats) mean() float64 {
+	return s.sum / float64(s.count)
+}
+
+// A channel's stats, empty if nothing's come in on it since they were reset
+func (h *channelHistory) statsOf(key string) *channelStats {
+	stats, ok := h.stats[key]
+	if !ok {
+		stats = newChannelStats()
+		h.stats[key] = stats
+	}
+	return stats
+}
+
+// Start counting how long a channel spends above a threshold, if we aren't already
+func (h *channelHistory) watchThreshold(key string, threshold float64) {
+	stats := h.statsOf(key)
+	if _, ok := stats.above[threshold]; !ok {
+		stats.above[threshold] = 0
+	}
+}
+
+// Count the time above every threshold in the layout, whichever page it's on
+func (h *channelHistory) watchThresholds(layout *dashboardLayout) {
+	for _, page := range layout.Pages {
+		for _, row := range page.Rows {
+			for i := range row.Widgets {
+				spec := &row.Widgets[i]
+				for j, threshold := range spec.thresholds() {
+					if threshold != nil {
+						h.watchThreshold(spec.keys[j], *threshold)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Start the stats over from now, still counting the time above the same thresholds
+func (h *channelHistory) resetStats(now time.Time) {
+	for key, stats := range h.stats {
+		fresh := newChannelStats()
+		for threshold := range stats.above {
+			fresh.above[threshold] = 0
+		}
+		h.stats[key] = fresh
+	}
+	h.statsSince = now
+}
+
+// The average of a channel's last n values, leaving out any from before the stats were reset
+func (h *channelHistory) average(key string, n int) (float64, bool) {
+	ring := h.ring(key)
+	sum, count := 0.0, 0
+	for i := ring.len() - 1; i >= 0 && count < n; i-- {
+		sample := ring.at(i)
+		if sample.at.Before(h.statsSince) {
+			break
+		}
+		sum += sample.value
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ziutek/ftdi"
+	"go.bug.st/serial"
+)
+
+// The transport used when nothing else has been asked for: the first FT232 on the bus
+const defaultMutTransport = "ftdi"
+
+// Default USB IDs of the FT232R found in most Tactrix/OpenPort style K-line cables
+const (
+	ftdiVendorId  = 0x0403
+	ftdiProductId = 0x6001
+)
+
+// MUT-II runs at 15625 baud, 8 data bits, 1 stop bit, no parity
+const mutBaudRate = 15625
+
+// How long the K-line is held low to emulate the 0x00 @ 5 baud wake up
+const mutInitBreak = 1800 * time.Millisecond
+
+// errTransportTimeout is returned when the ECU hasn't answered before the read deadline
+var errTransportTimeout = errors.New("transport: read timed out")
+
+// ecuTransport is anything that can carry the MUT byte stream to and from the ECU,
+// whether that is a USB cable on this machine or a bridge somewhere on the network
+type ecuTransport interface {
+	// WriteRequest sends the request bytes to the ECU
+	WriteRequest(data []byte) error
+
+	// ReadResponse reads until buf is full or the timeout expires,
+	// returning errTransportTimeout along with any partial read in the latter case
+	ReadResponse(buf []byte, timeout time.Duration) (int, error)
+
+	// SlowInit wakes the ECU up, which MUT does with 0x00 at 5 baud
+	SlowInit() error
+
+	// Purge discards anything waiting in the RX and TX buffers
+	Purge() error
+
+	Close() error
+
+	// String describes the transport for logs and the UI
+	String() string
+}
+
+// Open a transport from a spec string. Recognised forms are:
+//
+//	ftdi                    first FT232 with the default VID/PID
+//	ftdi:0403:6001          first FTDI device with the given VID/PID (hex)
+//	serial:/dev/ttyUSB0     any tty, such as a generic USB-serial K-line cable
+//	/dev/ttyUSB0            shorthand for the above
+//	tcp:host:port           a remote bridge that exposes the K-line as a raw TCP stream
+//	sim[:script.txt]        the built-in ECU simulator, connected in memory
+//	sim-pty[:script.txt]    the built-in ECU simulator, served on a pty and opened as a tty
+//
+// If we're capturing, everything that goes through the transport is recorded.
+func openTransport(spec string) (ecuTransport, error) {
+	transport, err := openTransportSpec(spec)
+	if err != nil || activeCapture == nil {
+		return transport, err
+	}
+	return newCapturingTransport(transport, activeCapture), nil
+}
+
+func openTransportSpec(spec string) (ecuTransport, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+
+	switch {
+	case kind == "ftdi":
+		vendorId, productId := ftdiVendorId, ftdiProductId
+		if arg != "" {
+			vid, pid, ok := strings.Cut(arg, ":")
+			if !ok {
+				return nil, fmt.Errorf("transport %q: expected ftdi:VID:PID", spec)
+			}
+			v, err := strconv.ParseUint(vid, 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("transport %q: bad vendor id: %w", spec, err)
+			}
+			p, err := strconv.ParseUint(pid, 16, 16)
+			if err != nil {
+				return nil, fmt.Errorf("transport %q: bad product id: %w", spec, err)
+			}
+			vendorId, productId = int(v), int(p)
+		}
+		return openFtdiTransport(vendorId, productId)
+	case kind == "serial":
+		return openSerialTransport(arg)
+	case strings.HasPrefix(spec, "/"):
+		return openSerialTransport(spec)
+	case kind == "tcp":
+		return openTcpTransport(arg)
+	case kind == "sim":
+		sim, err := loadMutSimulator(arg)
+		if err != nil {
+			return nil, err
+		}
+		return newSimTransport(sim), nil
+	case kind == "sim-pty":
+		return openSimPtyTransport(arg)
+	}
+
+	return nil, fmt.Errorf("unknown transport %q", spec)
+}
+
+// FTDI transport, talking to the chip directly through libftdi
+
+type ftdiTransport struct {
+	device    *ftdi.Device
+	vendorId  int
+	productId int
+}
+
+func openFtdiTransport(vendorId int, productId int) (*ftdiTransport, error) {
+	// Steps:
+	// Open the Serial Driver
+	// Reset the device
+	// Purge the RX and TX buffers on the device
+	// Set the baud rate to 15625 baud
+	// Set 8bits, 1 stop bit, no parity
+	// Disable flow control
+	// Set Latency timers
+	device, err := ftdi.OpenFirst(vendorId, productId, ftdi.ChannelAny)
+	if err != nil {
+		return nil, fmt.Errorf("opening FTDI %04x:%04x: %w", vendorId, productId, err)
+	}
+
+	for _, step := range []func() error{
+		device.Reset,
+		device.PurgeBuffers,
+		func() error { return device.SetBaudrate(mutBaudRate) },
+		func() error {
+			return device.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOff)
+		},
+		func() error { return device.SetFlowControl(ftdi.FlowCtrlDisable) },
+		func() error { return device.SetLatencyTimer(1) },
+	} {
+		if err := step(); err != nil {
+			device.Close()
+			return nil, fmt.Errorf("configuring FTDI %04x:%04x: %w", vendorId, productId, err)
+		}
+	}
+
+	return &ftdiTransport{device, vendorId, productId}, nil
+}
+
+func (t *ftdiTransport) WriteRequest(data []byte) error {
+	_, err := t.device.Write(data)
+	return err
+}
+
+func (t *ftdiTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	// libftdi reads don't block, they hand back whatever is sitting in the chip,
+	// so keep polling until we have enough or we run out of time
+	deadline := time.Now().Add(timeout)
+	n := 0
+	for n < len(buf) {
+		read, err := t.device.Read(buf[n:])
+		if err != nil {
+			return n, err
+		}
+		n += read
+		if n >= len(buf) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return n, errTransportTimeout
+		}
+		if read == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return n, nil
+}
+
+func (t *ftdiTransport) SlowInit() error {
+	// MUT requires 0x00 to be sent to the ECU to start the stream
+	// but at 5 baud. Instead, we can simply hold break
+	// to start the stream, which is basically the same thing.
+	// The original C code did the following between toggling break:
+	// usleep(1800 * 1000)
+	if err := t.device.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOn); err != nil {
+		return err
+	}
+	time.Sleep(mutInitBreak)
+	return t.device.SetLineProperties2(ftdi.DataBits8, ftdi.StopBits1, ftdi.ParityNone, ftdi.BreakOff)
+}
+
+func (t *ftdiTransport) Purge() error {
+	return t.device.PurgeBuffers()
+}
+
+func (t *ftdiTransport) Close() error {
+	return t.device.Close()
+}
+
+func (t *ftdiTransport) String() string {
+	return fmt.Sprintf("ftdi:%04x:%04x", t.vendorId, t.productId)
+}
+
+// Serial transport, for anything the OS exposes as a tty
+
+type serialTransport struct {
+	port serial.Port
+	path string
+}
+
+func openSerialTransport(path string) (*serialTransport, error) {
+	if path == "" {
+		return nil, errors.New("serial transport needs a port, e.g. serial:/dev/ttyUSB0")
+	}
+
+	serialMode := &serial.Mode{
+		BaudRate: mutBaudRate,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+		Parity:   serial.NoParity,
+	}
+	port, err := serial.Open(path, serialMode)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	return &serialTransport{port, path}, nil
+}
+
+func (t *serialTransport) WriteRequest(data []byte) error {
+	_, err := t.port.Write(data)
+	return err
+}
+
+func (t *serialTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	n := 0
+	for n < len(buf) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return n, errTransportTimeout
+		}
+		if err := t.port.SetReadTimeout(remaining); err != nil {
+			return n, err
+		}
+		read, err := t.port.Read(buf[n:])
+		if err != nil {
+			return n, err
+		}
+		// A zero length read means the timeout expired
+		if read == 0 {
+			return n, errTransportTimeout
+		}
+		n += read
+	}
+	return n, nil
+}
+
+func (t *serialTransport) SlowInit() error {
+	return t.port.Break(mutInitBreak)
+}
+
+func (t *serialTransport) Purge() error {
+	if err := t.port.ResetInputBuffer(); err != nil {
+		return err
+	}
+	return t.port.ResetOutputBuffer()
+}
+
+func (t *serialTransport) Close() error {
+	return t.port.Close()
+}
+
+func (t *serialTransport) String() string {
+	return "serial:" + t.path
+}
+
+// TCP transport, for a remote bridge (ser2net or similar) that owns the K-line
+
+type tcpTransport struct {
+	conn    net.Conn
+	address string
+}
+
+func openTcpTransport(address string) (*tcpTransport, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", address, err)
+	}
+	return &tcpTransport{conn, address}, nil
+}
+
+func (t *tcpTransport) WriteRequest(data []byte) error {
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *tcpTransport) ReadResponse(buf []byte, timeout time.Duration) (int, error) {
+	if err := t.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	n := 0
+	for n < len(buf) {
+		read, err := t.conn.Read(buf[n:])
+		n += read
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return n, errTransportTimeout
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (t *tcpTransport) SlowInit() error {
+	// A raw TCP stream has no way to signal break, so the bridge
+	// is expected to have woken the ECU up on its side of the link.
+	// All we can do is make sure we start from a clean slate.
+	return t.Purge()
+}
+
+func (t *tcpTransport) Purge() error {
+	// Drain anything the bridge has already queued up for us
+	var scratch [64]byte
+	for {
+		if err := t.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+			return err
+		}
+		n, err := t.conn.Read(scratch[:])
+		if n == 0 || err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTransport) String() string {
+	return "tcp:" + t.address
+}